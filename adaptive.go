@@ -0,0 +1,107 @@
+package logplexc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Bounds and pace of the adaptation of the request size trigger to
+// the success of recent posts, per Config.AdaptiveBatchSize.
+const (
+	adaptiveWindow     = 100
+	adaptiveInterval   = 10
+	minAdaptiveTrigger = 512
+)
+
+// Adjusts the request size trigger in light of how many of the last
+// adaptiveWindow posts succeeded, every adaptiveInterval posts.
+type adaptiveTrigger struct {
+	// The current trigger, accessed atomically.
+	trigger int64
+	max     int64
+
+	mu        sync.Mutex
+	outcomes  [adaptiveWindow]bool
+	n, next   int
+	successes int
+	sinceLast int
+}
+
+func newAdaptiveTrigger(initial, max int) *adaptiveTrigger {
+	if max < initial {
+		max = initial
+	}
+
+	return &adaptiveTrigger{trigger: int64(initial), max: int64(max)}
+}
+
+func (a *adaptiveTrigger) current() int {
+	return int(atomic.LoadInt64(&a.trigger))
+}
+
+// Record the outcome of a post, and adjust the trigger if it is
+// time to: halving it while fewer than half of recent posts succeed,
+// and growing it by a tenth while more than nine in ten do.
+func (a *adaptiveTrigger) record(ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.n == adaptiveWindow {
+		if a.outcomes[a.next] {
+			a.successes -= 1
+		}
+	} else {
+		a.n += 1
+	}
+
+	a.outcomes[a.next] = ok
+	a.next = (a.next + 1) % adaptiveWindow
+	if ok {
+		a.successes += 1
+	}
+
+	a.sinceLast += 1
+	if a.sinceLast < adaptiveInterval {
+		return
+	}
+	a.sinceLast = 0
+
+	rate := float64(a.successes) / float64(a.n)
+	trigger := atomic.LoadInt64(&a.trigger)
+
+	switch {
+	case rate < 0.5:
+		halved := trigger / 2
+		if halved < minAdaptiveTrigger {
+			halved = minAdaptiveTrigger
+		}
+
+		// A trigger that started below the minimum stays put.
+		if halved < trigger {
+			trigger = halved
+		}
+	case rate > 0.9:
+		trigger += trigger / 10
+		if trigger > a.max {
+			trigger = a.max
+		}
+	}
+
+	atomic.StoreInt64(&a.trigger, trigger)
+}
+
+// The request size at which buffering triggers a post.
+func (m *Client) sizeTrigger() int {
+	if m.adaptive != nil {
+		return m.adaptive.current()
+	}
+
+	return m.RequestSizeTrigger
+}
+
+// Record the outcome of a post, if adapting to them.
+func (m *Client) adapt(ok bool) {
+	if m.adaptive != nil {
+		m.adaptive.record(ok)
+	}
+}
@@ -0,0 +1,162 @@
+package logplexc
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Buffer messages from n goroutines at once, posting through
+// NoopTripper so that only the Client's own costs are measured.
+func BenchmarkClientBufferMessage(b *testing.B) {
+	msg := bytes.Repeat([]byte("x"), 512)
+
+	for _, bc := range []struct {
+		name string
+		n    int
+	}{
+		{"goroutines=1", 1},
+		{"goroutines=4", 4},
+		{"goroutines=16", 16},
+		{"goroutines=GOMAXPROCS", runtime.GOMAXPROCS(0)},
+	} {
+		n := bc.n
+		b.Run(bc.name, func(b *testing.B) {
+			c := NewNoopClient(b, 100*KB)
+			defer c.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for g := 0; g < n; g += 1 {
+				// Share out b.N, giving the first
+				// goroutines one more each as needed.
+				count := b.N / n
+				if g < b.N%n {
+					count += 1
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					now := time.Now()
+					for i := 0; i < count; i += 1 {
+						c.BufferMessage(LevelInfo, now,
+							"host", "web.1", msg)
+					}
+				}()
+			}
+
+			wg.Wait()
+			b.StopTimer()
+		})
+	}
+}
+
+// Frame 512-byte messages into a MiniClient's bundle.
+func BenchmarkMiniClientFraming(b *testing.B) {
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex: BogusLogplexUrl,
+		Token:   testToken,
+	})
+	if err != nil {
+		b.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	msg := bytes.Repeat([]byte("x"), 512)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += 1 {
+		s := c.BufferMessage(now, "host", "web.1", msg)
+
+		// Keep the bundle to a realistic size.
+		if s.Buffered >= 100*KB {
+			c.ReleaseBundle(c.SwapBundle())
+		}
+	}
+}
+
+// Take Statistics from every P at once, while another goroutine
+// updates the statistics as fast as it can: of a fresh Client, and
+// of one with a full window of concurrency samples and as many
+// sources as are tracked, as a Client that has run a while has.
+func BenchmarkStatLock(b *testing.B) {
+	b.Run("fresh", func(b *testing.B) {
+		c := NewNoopClient(b, 100*KB)
+		defer c.Close()
+
+		benchmarkStatLock(b, c)
+	})
+
+	b.Run("steady", func(b *testing.B) {
+		c := NewNoopClient(b, 100*KB)
+		defer c.Close()
+
+		for i := 0; i < concurrencySampleCount; i += 1 {
+			c.statConcurrencySample(int32(i % 8))
+		}
+
+		c.sources = newSourceTracker(maxTrackedSources)
+		for i := 0; i < maxTrackedSources; i += 1 {
+			c.sources.count("host", "web."+strconv.Itoa(i), i)
+		}
+
+		benchmarkStatLock(b, c)
+	})
+}
+
+// Count messages from ten times as many sources as are tracked, so
+// that nearly every message makes room for its source by forgetting
+// another.
+func BenchmarkSourceTrackerEvict(b *testing.B) {
+	st := newSourceTracker(maxTrackedSources)
+	procIds := make([]string, 10*maxTrackedSources)
+	for i := range procIds {
+		procIds[i] = "web." + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		st.count("host", procIds[i%len(procIds)], 100)
+	}
+}
+
+func benchmarkStatLock(b *testing.B, c *Client) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				// Counted under statLock, as filtered.
+				c.statFiltered(1)
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Statistics()
+		}
+	})
+
+	b.StopTimer()
+	close(done)
+	<-stopped
+}
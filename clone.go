@@ -0,0 +1,68 @@
+package logplexc
+
+import "errors"
+
+// Create a Client that posts with the workers of this one, e.g. with
+// a different Token for each tenant of a service, without each
+// having a pool of workers of its own.
+//
+// The clone is configured by overrides as NewClient would be, except
+// that Concurrency, TimeTrigger and Period are ignored: its posts take
+// their turns with those of this Client, and it is flushed along with
+// this Client.  It has a MiniClient and Stats of its own.
+//
+// Closing the clone leaves this Client running, while closing this
+// Client closes its clones first.
+func (m *Client) Clone(overrides *Config) (*Client, error) {
+	if overrides == nil {
+		return nil, errors.New(
+			"logplexc.Client: Clone requires a Config")
+	}
+
+	return newClient(overrides, m)
+}
+
+func (m *Client) addClone(clone *Client) error {
+	m.clonesLock.Lock()
+	defer m.clonesLock.Unlock()
+
+	if m.clonesClosed {
+		return ErrClientClosed
+	}
+
+	if m.clones == nil {
+		m.clones = make(map[*Client]struct{})
+	}
+
+	m.clones[clone] = struct{}{}
+	return nil
+}
+
+func (m *Client) removeClone(clone *Client) {
+	m.clonesLock.Lock()
+	defer m.clonesLock.Unlock()
+
+	delete(m.clones, clone)
+}
+
+// Call fn with each clone.  Clones are not closed while fn runs.
+func (m *Client) eachClone(fn func(clone *Client)) {
+	m.clonesLock.RLock()
+	defer m.clonesLock.RUnlock()
+
+	for clone := range m.clones {
+		fn(clone)
+	}
+}
+
+func (m *Client) closeClones() {
+	m.clonesLock.Lock()
+	clones := m.clones
+	m.clones = nil
+	m.clonesClosed = true
+	m.clonesLock.Unlock()
+
+	for clone := range clones {
+		clone.Close()
+	}
+}
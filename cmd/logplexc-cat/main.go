@@ -0,0 +1,94 @@
+// Command logplexc-cat ships the lines of its standard input to
+// Logplex, one message per line.
+//
+// It is configured from the environment as a Heroku dyno is, by
+// LOGPLEX_URL and LOGPLEX_TOKEN (see logplexc.ConfigFromEnv).  On end
+// of input or SIGTERM, whatever is buffered is flushed, and the
+// Client's final statistics are written to standard error as JSON.
+//
+//	some-program | logplexc-cat -host my-app -procid web.1
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/heroku/logplexc"
+)
+
+func main() {
+	host := flag.String("host", envOr("HEROKU_APP_NAME", "localhost"),
+		"the host messages are framed with")
+	procId := flag.String("procid", envOr("DYNO", "logplexc-cat"),
+		"the procId messages are framed with")
+	flag.Parse()
+
+	c, err := logplexc.NewClientFromHerokuEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logplexc-cat: %v\n", err)
+		os.Exit(1)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- buffer(c, os.Stdin, *host, *procId)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+
+	status := 0
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logplexc-cat: reading input: %v\n",
+				err)
+			status = 1
+		}
+	case <-sigs:
+	}
+
+	if err := c.GracefulClose(); err != nil {
+		fmt.Fprintf(os.Stderr, "logplexc-cat: flushing: %v\n", err)
+		status = 1
+	}
+
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "\t")
+	enc.Encode(c.Statistics())
+
+	os.Exit(status)
+}
+
+// Buffer each line read from f as a message, until end of input.
+func buffer(c *logplexc.Client, f *os.File, host, procId string) error {
+	s := bufio.NewScanner(f)
+
+	// Allow for long lines, of up to a megabyte.
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for s.Scan() {
+		err := c.BufferMessage(logplexc.LevelInfo, time.Now(), host,
+			procId, s.Bytes())
+		if err != nil {
+			// Closed on SIGTERM.
+			return nil
+		}
+	}
+
+	return s.Err()
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return fallback
+}
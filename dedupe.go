@@ -0,0 +1,98 @@
+package logplexc
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Number of messages remembered for deduplication when
+// Config.DedupeMaxEntries is not set.
+const defaultDedupeMaxEntries = 1024
+
+// Recognizes messages identical to one buffered recently, by hash.
+//
+// The most recently seen messages are remembered in least-recently
+// used order, up to maxEntries of them.
+type deduper struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	lru     list.List
+}
+
+type dedupeEntry struct {
+	hash     uint64
+	buffered time.Time
+}
+
+func newDeduper(window time.Duration, maxEntries int) *deduper {
+	if maxEntries <= 0 {
+		maxEntries = defaultDedupeMaxEntries
+	}
+
+	return &deduper{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[uint64]*list.Element),
+	}
+}
+
+// Report whether a message is a duplicate of one buffered less than
+// the window ago, along with its hash, for remembering it with record
+// once it is buffered.  A nil deduper sees no duplicates.
+//
+// Checking and remembering are separate so that a message turned
+// away for some other reason, such as the rate limit, is not taken
+// for having been buffered.
+func (d *deduper) duplicate(now time.Time,
+	host string, procId string, log []byte) (hash uint64, dup bool) {
+	if d == nil {
+		return 0, false
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(procId))
+	h.Write([]byte{0})
+	h.Write(log)
+	hash = h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[hash]; ok {
+		e := el.Value.(*dedupeEntry)
+		return hash, now.Sub(e.buffered) < d.window
+	}
+
+	return hash, false
+}
+
+// Remember the message with the hash as buffered now.
+func (d *deduper) record(now time.Time, hash uint64) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[hash]; ok {
+		d.lru.MoveToFront(el)
+		el.Value.(*dedupeEntry).buffered = now
+		return
+	}
+
+	d.entries[hash] = d.lru.PushFront(&dedupeEntry{hash, now})
+
+	if d.lru.Len() > d.maxEntries {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupeEntry).hash)
+	}
+}
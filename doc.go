@@ -0,0 +1,30 @@
+// Package logplexc is a client for emitting logs to Logplex.
+//
+// There are two levels of API.
+//
+// The high-level API is Client, which takes care of most everything:
+// messages passed to BufferMessage are framed and accumulated, and
+// posted to Logplex when enough have accrued or when enough time has
+// passed.  Posting happens in the background with bounded concurrency,
+// and when all the workers are busy, messages are dropped rather than
+// allowed to slow down the program emitting them.  Statistics
+// record what happened to every message.
+//
+// The low-level API is MiniClient, which only frames messages and
+// posts them, leaving all matters of scheduling to the caller.  It is
+// for programs that need a different strategy than Client's, such as
+// a dispatcher that bridges from a queue and would rather apply back
+// pressure than drop.  Its life cycle is:
+//
+//	BufferMessage, as many times as desired, then
+//	SwapBundle, to take the messages buffered so far, then
+//	Post, to submit them, and finally
+//	ReleaseBundle, to recycle the Bundle's storage.
+//
+// ReleaseBundle can follow Post straight away: the Bundle's storage is
+// not re-used until the HTTP transport has closed the request body,
+// even should it go on reading after the response has arrived.
+//
+// A MiniClient's methods are safe for concurrent use, so buffering
+// can proceed while a swapped-out Bundle is being posted.
+package logplexc
@@ -0,0 +1,55 @@
+package logplexc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// The form of the tokens Heroku issues for log drains: "t." and then,
+// typically, a UUID.
+var tokenPattern = regexp.MustCompile(`^t\.[a-zA-Z0-9_-]{20,}$`)
+
+// Check that a token is of the form Heroku issues, as a token of any
+// other form is certain to be refused by Logplex.
+func validateToken(token string) error {
+	if !tokenPattern.MatchString(token) {
+		return errors.New("logplexc.Client: token is not of the " +
+			"form t.<at least 20 letters, digits, _ or ->")
+	}
+
+	return nil
+}
+
+// Resolve Config.DrainURL into Config.Logplex, and Config.Token if
+// that is empty and the URL has a password, leaving cfg as it is.
+func resolveDrainURL(cfg *Config) (*Config, error) {
+	if cfg.DrainURL == "" {
+		return cfg, nil
+	}
+
+	if cfg.Logplex.Host != "" {
+		return nil, errors.New("logplexc.Client: only one of " +
+			"Logplex and DrainURL can be set")
+	}
+
+	u, err := url.Parse(cfg.DrainURL)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"logplexc.Client: could not parse DrainURL: %v", err)
+	}
+
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("logplexc.Client: DrainURL %q is not "+
+			"an https URL with a host", u.Redacted())
+	}
+
+	resolved := *cfg
+	resolved.Logplex = *u
+	if resolved.Token == "" && u.User != nil {
+		resolved.Token, _ = u.User.Password()
+	}
+
+	return &resolved, nil
+}
@@ -0,0 +1,115 @@
+package logplexc
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often a warning about dropping is repeated while the drop rate
+// remains high, when Config.DropWarnCooldown is not set.
+const defaultDropWarnCooldown = time.Minute
+
+// Watches the fraction of messages dropped over the last minute, to
+// warn when it rises above a threshold, and to say so once it falls
+// back.
+//
+// It is checked once a second, with statLock held.
+type dropWatch struct {
+	threshold float64
+	cooldown  time.Duration
+	logger    *log.Logger
+	endpoint  string
+
+	// The cumulative Total and Dropped at each of the last
+	// checks, in a ring.
+	samples [rateWindowSeconds]dropSample
+	next    int
+	filled  int
+
+	warning  bool
+	lastWarn time.Time
+}
+
+type dropSample struct {
+	total   uint64
+	dropped uint64
+}
+
+func newDropWatch(threshold float64, cooldown time.Duration,
+	logger *log.Logger, endpoint string) *dropWatch {
+	if cooldown <= 0 {
+		cooldown = defaultDropWarnCooldown
+	}
+
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &dropWatch{
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+		endpoint:  endpoint,
+	}
+}
+
+// Take in the cumulative Total and Dropped as of now, returning the
+// line to log, if any.
+func (dw *dropWatch) check(now time.Time, total, dropped uint64) string {
+	// Until a minute of samples has accrued, compare with the
+	// start.
+	var base dropSample
+	if dw.filled == rateWindowSeconds {
+		base = dw.samples[dw.next]
+	}
+
+	dw.samples[dw.next] = dropSample{total: total, dropped: dropped}
+	dw.next = (dw.next + 1) % rateWindowSeconds
+	if dw.filled < rateWindowSeconds {
+		dw.filled += 1
+	}
+
+	n := total - base.total
+	if n == 0 {
+		return ""
+	}
+
+	rate := float64(dropped-base.dropped) / float64(n)
+	switch {
+	case rate > dw.threshold:
+		if dw.warning && now.Sub(dw.lastWarn) < dw.cooldown {
+			return ""
+		}
+
+		dw.warning = true
+		dw.lastWarn = now
+		return fmt.Sprintf("logplexc.Client: warning: dropped %.1f%% "+
+			"of %d messages in the last minute, above %.1f%%, "+
+			"posting to %s", rate*100, n, dw.threshold*100,
+			dw.endpoint)
+	case dw.warning:
+		dw.warning = false
+		return fmt.Sprintf("logplexc.Client: info: dropped %.1f%% "+
+			"of %d messages in the last minute, back within "+
+			"%.1f%%, posting to %s", rate*100, n,
+			dw.threshold*100, dw.endpoint)
+	}
+
+	return ""
+}
+
+// Check the drop rate, if watched, and log about it as need be.
+func (m *Client) checkDropRate(now time.Time) {
+	if m.dropWatch == nil {
+		return
+	}
+
+	m.statLock.Lock()
+	line := m.dropWatch.check(now, m.Total, m.Dropped)
+	m.statLock.Unlock()
+
+	if line != "" {
+		m.dropWatch.logger.Print(line)
+	}
+}
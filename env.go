@@ -0,0 +1,68 @@
+package logplexc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Defaults of the Config returned by ConfigFromEnv.
+const (
+	envDefaultConcurrency        = 4
+	envDefaultPeriod             = 500 * time.Millisecond
+	envDefaultRequestSizeTrigger = 100 * 1024
+)
+
+// Make a Config from the environment of a Heroku dyno.
+//
+// LOGPLEX_URL is required.  The token is taken from LOGPLEX_TOKEN, or
+// failing that from the password of LOGPLEX_URL.  The rest of the
+// Config is set to defaults that suit most programs: a Concurrency of
+// 4, a Period of 500ms, and a RequestSizeTrigger of 100KB.
+func ConfigFromEnv() (Config, error) {
+	rawUrl := os.Getenv("LOGPLEX_URL")
+	if rawUrl == "" {
+		return Config{}, errors.New(
+			"logplexc.Client: LOGPLEX_URL is not set")
+	}
+
+	logplexUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return Config{}, fmt.Errorf(
+			"logplexc.Client: could not parse LOGPLEX_URL: %v", err)
+	}
+
+	token := os.Getenv("LOGPLEX_TOKEN")
+	if token == "" && logplexUrl.User != nil {
+		token, _ = logplexUrl.User.Password()
+	}
+
+	if token == "" {
+		return Config{}, errors.New("logplexc.Client: no token in " +
+			"LOGPLEX_TOKEN or LOGPLEX_URL")
+	}
+
+	return Config{
+		Logplex:            *logplexUrl,
+		Token:              token,
+		RequestSizeTrigger: envDefaultRequestSizeTrigger,
+		Concurrency:        envDefaultConcurrency,
+		Period:             envDefaultPeriod,
+	}, nil
+}
+
+// Create a Client configured by ConfigFromEnv.
+//
+// Messages are still framed with the host and procId passed to
+// BufferMessage; on Heroku, these are conventionally the app name
+// (HEROKU_APP_NAME) and the dyno name (DYNO).
+func NewClientFromHerokuEnv() (*Client, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(&cfg)
+}
@@ -0,0 +1,42 @@
+package logplexc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"unicode/utf8"
+)
+
+// What to do with message bodies that are not valid UTF-8, which
+// syslog requires of them.
+type EscapePolicy byte
+
+const (
+	// The zero-value leaves message bodies as they are.
+	EscapeNone EscapePolicy = iota
+
+	// Replace each run of invalid bytes with U+FFFD, the Unicode
+	// replacement character.
+	EscapeInvalid
+
+	// Replace the whole body with its standard base64 encoding.
+	EscapeBase64
+)
+
+// Apply a policy to a message body, returning it unchanged if it is
+// already valid UTF-8, and otherwise an escaped copy and true.
+func escapeMessage(policy EscapePolicy, log []byte) ([]byte, bool) {
+	if policy == EscapeNone || utf8.Valid(log) {
+		return log, false
+	}
+
+	switch policy {
+	case EscapeInvalid:
+		return bytes.ToValidUTF8(log, []byte("\uFFFD")), true
+	case EscapeBase64:
+		escaped := make([]byte, base64.StdEncoding.EncodedLen(len(log)))
+		base64.StdEncoding.Encode(escaped, log)
+		return escaped, true
+	default:
+		return log, false
+	}
+}
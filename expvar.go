@@ -0,0 +1,68 @@
+package logplexc
+
+import (
+	"expvar"
+	"sync"
+)
+
+// The Clients published to expvar, by name.
+//
+// expvar offers no way of withdrawing a variable once published, so
+// each name is published only once, as a function that looks up
+// whichever Client currently goes by that name.
+var expvars = struct {
+	sync.Mutex
+	published map[string]bool
+	clients   map[string]*Client
+}{
+	published: make(map[string]bool),
+	clients:   make(map[string]*Client),
+}
+
+// Publish the Client's Statistics as the expvar variable name, and so
+// on the /debug/vars page.  The JSON object's keys are the names of
+// the fields of Stats.
+//
+// Registering a name again, on this Client or another, replaces the
+// earlier registration.  As with expvar.Publish, it is a panic to
+// register a name already used by another expvar variable.
+func (m *Client) RegisterExpvar(name string) {
+	expvars.Lock()
+	defer expvars.Unlock()
+
+	if !expvars.published[name] {
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return expvarStats(name)
+		}))
+		expvars.published[name] = true
+	}
+
+	expvars.clients[name] = m
+}
+
+// Withdraw a registration made with RegisterExpvar.  The variable
+// remains, as expvar requires, but reports null.
+func (m *Client) UnregisterExpvar(name string) {
+	expvars.Lock()
+	defer expvars.Unlock()
+
+	if expvars.clients[name] == m {
+		delete(expvars.clients, name)
+	}
+}
+
+func expvarStats(name string) interface{} {
+	expvars.Lock()
+	m := expvars.clients[name]
+	expvars.Unlock()
+
+	if m == nil {
+		return nil
+	}
+
+	// Without the methods of Stats, and so its MarshalJSON, for
+	// the keys to stay the names of the fields.
+	return statsFields(m.Statistics())
+}
+
+type statsFields Stats
@@ -0,0 +1,116 @@
+package logplexc
+
+import (
+	"io"
+	"time"
+)
+
+// How long a write to Config.FallbackWriter may take before it is
+// given up on, when Config.FallbackWriteTimeout is not set.
+const defaultFallbackWriteTimeout = 100 * time.Millisecond
+
+// Writes the messages that a failed post is to drop, one syslog line
+// each, to an io.Writer that may be slow or stuck.
+//
+// Only one write is ever in progress: busy holds a token for as long
+// as it lasts, so that lines of different bundles do not interleave
+// and a stuck writer holds up one goroutine at most.
+type fallbackWriter struct {
+	w       io.Writer
+	timeout time.Duration
+	busy    chan struct{}
+}
+
+func newFallbackWriter(w io.Writer, timeout time.Duration) *fallbackWriter {
+	if timeout <= 0 {
+		timeout = defaultFallbackWriteTimeout
+	}
+
+	fw := fallbackWriter{
+		w:       w,
+		timeout: timeout,
+		busy:    make(chan struct{}, 1),
+	}
+
+	return &fw
+}
+
+// Write the messages of b for which lost is true, or all of them if
+// lost is nil, returning false if the writer was still busy with an
+// earlier write after waiting for the timeout.
+func (fw *fallbackWriter) write(b *Bundle, lost []bool) bool {
+	var lines []byte
+	i := 0
+	b.each(func(msg []byte) {
+		if lost == nil || (i < len(lost) && lost[i]) {
+			lines = append(lines, msg...)
+			lines = append(lines, '\n')
+		}
+
+		i += 1
+	})
+
+	if len(lines) == 0 {
+		return true
+	}
+
+	t := time.NewTimer(fw.timeout)
+	defer t.Stop()
+
+	select {
+	case fw.busy <- struct{}{}:
+	case <-t.C:
+		return false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer func() { <-fw.busy }()
+		defer close(done)
+
+		fw.w.Write(lines)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Wait, for no longer than the timeout, for a write still in
+// progress to finish.
+func (fw *fallbackWriter) wait() {
+	t := time.NewTimer(fw.timeout)
+	defer t.Stop()
+
+	select {
+	case fw.busy <- struct{}{}:
+		<-fw.busy
+	case <-t.C:
+	}
+}
+
+// Write the messages of a failed post that are not to be recovered to
+// Config.FallbackWriter, if there is one, counting them in
+// Stats.FallbackSkipped should it not keep up.
+func (m *Client) writeFallback(b *Bundle, lost []bool) {
+	if m.fallback == nil {
+		return
+	}
+
+	if !m.fallback.write(b, lost) {
+		n := b.NumberFramed
+		if lost != nil {
+			n = 0
+			for _, l := range lost {
+				if l {
+					n += 1
+				}
+			}
+		}
+
+		m.statFallbackSkipped(n)
+	}
+}
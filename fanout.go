@@ -0,0 +1,32 @@
+package logplexc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Post a bundle to each of the fanout Logplexes concurrently, adding
+// the posts to wg.  The bundle must not be released until wg is done.
+func (m *Client) postFanout(wg *sync.WaitGroup, b *Bundle) {
+	wg.Add(len(m.fanout))
+
+	for _, u := range m.fanout {
+		go func(u url.URL) {
+			defer wg.Done()
+
+			resp, err := m.c.postTo(context.Background(), u, b)
+			if err != nil {
+				m.statFanoutFailed()
+				return
+			}
+
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNoContent {
+				m.statFanoutFailed()
+			}
+		}(u)
+	}
+}
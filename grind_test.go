@@ -3,8 +3,10 @@ package logplexc
 import (
 	"bytes"
 	"crypto/tls"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"runtime"
@@ -55,7 +57,7 @@ func BenchmarkStartup(b *testing.B) {
 		RequestSizeTrigger: 100,
 		Concurrency:        3,
 		Period:             3 * time.Second,
-		Token:              "a-token",
+		Token:              testToken,
 	}
 
 	for i := 0; i < b.N; i += 1 {
@@ -72,13 +74,7 @@ func BenchmarkStartup(b *testing.B) {
 	}
 }
 
-// Measure how costly non-transport machinery by writing out logs from
-// one goroutine as fast as possible to a no-op transport, but
-// accumulating statistics.
-func doFanInOutBench(b *testing.B, c *Client, inputConcur int) {
-	b.StopTimer()
-
-	log := []byte(`It was the best of times, it was the worst of
+var taleOfTwoCities = []byte(`It was the best of times, it was the worst of
 times, it was the age of wisdom, it was the age of foolishness, it was
 the epoch of belief, it was the epoch of incredulity, it was the
 season of Light, it was the season of Darkness, it was the spring of
@@ -89,6 +85,12 @@ present period, that some of its noisiest authorities insisted on its
 being received, for good or for evil, in the superlative degree of
 comparison only.`)
 
+// Measure how costly non-transport machinery by writing out logs from
+// one goroutine as fast as possible to a no-op transport, but
+// accumulating statistics.
+func doFanInOutBench(b *testing.B, c *Client, inputConcur int) {
+	b.StopTimer()
+
 	defer c.Close()
 	t := time.Now()
 
@@ -101,7 +103,8 @@ comparison only.`)
 	for i := 0; i < inputConcur; i += 1 {
 		go func() {
 			for i := 0; i < perGoroutinePayload; i += 1 {
-				c.BufferMessage(t, "UK", "CharlesDickens", log)
+				c.BufferMessage(LevelInfo, t, "UK",
+					"CharlesDickens", taleOfTwoCities)
 			}
 
 			done <- true
@@ -135,7 +138,7 @@ func NewNoopClient(f interface {
 		RequestSizeTrigger: sizeTrigger,
 		Concurrency:        3,
 		Period:             3 * time.Second,
-		Token:              "a-token",
+		Token:              testToken,
 	}
 
 	c, err := NewClient(&cfg)
@@ -216,3 +219,105 @@ func BenchmarkToUrl(b *testing.B) {
 
 	doFanInOutBench(b, c, 1)
 }
+
+// Like doFanInOutBench, but buffering through BulkBufferMessages in
+// batches of batchSize.
+func doBulkFanInOutBench(b *testing.B, c *Client, inputConcur int,
+	batchSize int) {
+	b.StopTimer()
+
+	defer c.Close()
+
+	batch := make([]LogEntry, batchSize)
+	for i := range batch {
+		batch[i] = LogEntry{
+			Level:  LevelInfo,
+			When:   time.Now(),
+			Host:   "UK",
+			ProcId: "CharlesDickens",
+			Log:    taleOfTwoCities,
+		}
+	}
+
+	done := make(chan bool, inputConcur)
+	perGoroutinePayload := b.N / inputConcur / batchSize
+
+	b.StartTimer()
+
+	for i := 0; i < inputConcur; i += 1 {
+		go func() {
+			for i := 0; i < perGoroutinePayload; i += 1 {
+				c.BulkBufferMessages(batch)
+			}
+
+			done <- true
+		}()
+	}
+
+	for i := 0; i < inputConcur; i += 1 {
+		<-done
+	}
+
+	b.StopTimer()
+}
+
+// Compare with BenchmarkFanInOut: the same messages, but in batches.
+func BenchmarkFanInOutBulk(b *testing.B) {
+	doBulkFanInOutBench(b, NewNoopClient(b, 100*KB), 500, 100)
+}
+
+// Post one message at a time to a loopback HTTPS server, with and
+// without reusing connections, to show the cost of TLS handshakes.
+func BenchmarkKeepAlive(b *testing.B) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		b.Fatalf("Could not parse test server url: %v", err)
+	}
+
+	tlsConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, bc := range []struct {
+		name    string
+		disable bool
+	}{
+		{"On", false},
+		{"Off", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := Config{
+				Logplex:            *u,
+				Token:              testToken,
+				RequestSizeTrigger: 100 * KB,
+				Concurrency:        1,
+				TimeTrigger:        TimeTriggerNever,
+				TLSConfig:          tlsConfig,
+				MaxIdleConns:       1,
+				DisableKeepAlives:  bc.disable,
+			}
+
+			c, err := NewClient(&cfg)
+			if err != nil {
+				b.Fatalf("Could not construct new client: %v", err)
+			}
+			defer c.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 1 {
+				c.BufferMessage(LevelInfo, time.Now(), "UK",
+					"CharlesDickens", []byte("It was the best "+
+						"of times"))
+				if err := c.Flush(); err != nil {
+					b.Fatalf("Could not flush: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
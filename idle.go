@@ -0,0 +1,52 @@
+package logplexc
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Block until no workers are posting and nothing is on its way to
+// them, or ctx is done, in which case ctx.Err() is returned.
+//
+// Messages buffered but not yet due to be posted are not waited for;
+// see Flush.  WaitIdle may be called concurrently with buffering,
+// though it may then never find the Client idle.
+func (m *Client) WaitIdle(ctx context.Context) error {
+	for {
+		m.idleLock.Lock()
+		changed := m.idleChanged
+		idle := m.workersExited ||
+			(atomic.LoadInt32(&m.concurrency) == 0 &&
+				len(m.bucket) == cap(m.bucket))
+		m.idleLock.Unlock()
+
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Wake up WaitIdle callers to check again.
+func (m *Client) signalIdle() {
+	m.idleLock.Lock()
+	defer m.idleLock.Unlock()
+
+	close(m.idleChanged)
+	m.idleChanged = make(chan struct{})
+}
+
+// Record that all workers have exited for good, as Close has waited
+// for them, whether or not they returned their tokens.
+func (m *Client) signalWorkersExited() {
+	m.idleLock.Lock()
+	m.workersExited = true
+	m.idleLock.Unlock()
+
+	m.signalIdle()
+}
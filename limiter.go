@@ -0,0 +1,59 @@
+package logplexc
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket that fills at rate tokens per second, holding up to
+// burst of them.  Each message admitted takes one token.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Create a rateLimiter that starts out full.  A burst below one is
+// taken as one, or no message could ever be admitted.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take a token if one is available.  A nil rateLimiter admits
+// everything.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+
+		l.last = now
+	}
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens -= 1
+	return true
+}
@@ -1,11 +1,19 @@
-// A client implementation that includes concurrency and dropping.
 package logplexc
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,13 +23,36 @@ type Stats struct {
 	// Number of concurrent requests at the time of retrieval.
 	Concurrency int32
 
+	// The 95th percentile of Concurrency, sampled every 100ms
+	// over the last five minutes.
+	ConcurrencyP95 int32
+
+	// Number of bundles at the time of retrieval that are ready
+	// to post, but waiting for earlier bundles for the same
+	// procId to be posted first, per Config.OrderByProcId.
+	// Bundles that find no worker free do not wait, but are
+	// dropped, so without OrderByProcId this is always zero.
+	BundleQueueDepth int
+
+	// Number of bundles at the time of retrieval that have been
+	// handed to a worker, but are yet to be posted, for
+	// Config.MaxQueuedBundles.  Bundles posted by Flush are not
+	// counted.
+	QueueDepth int32
+
+	// The UUID of the bundle being buffered to at the time of
+	// retrieval, which is sent with it as the X-Bundle-ID header.
+	// Empty while nothing is buffered.
+	CurrentBundleID string
+
 	// Message-level statistics
 
 	// Total messages submitted
 	Total uint64
 
 	// Incremented when a message is ignored outright because of
-	// too much work being done already.
+	// too much work being done already, or for exceeding
+	// Config.MaxMessagesPerSecond.
 	Dropped uint64
 
 	// Incremented when a log post request is not known to have
@@ -36,15 +67,116 @@ type Stats struct {
 	// logplex.
 	Successful uint64
 
+	// The part of Successful that was only delivered after
+	// failing before, and being buffered again per
+	// Config.RecoverOnError or Config.MessageRetryBudget.
+	SuccessAfterRetry uint64
+
+	// Incremented when a message is discarded for being below
+	// Config.MinLevel.  Filtered messages are not counted in
+	// Total.
+	Filtered uint64
+
+	// Incremented when a message is discarded, rather than sent,
+	// for being older than Config.MaxMessageAge.  Such messages
+	// are not counted in Total either.
+	AgeDropped uint64
+
+	// Incremented when a message is discarded for repeating one
+	// buffered within Config.DedupeWindow.  Deduped messages are
+	// not counted in Total.
+	Deduped uint64
+
+	// Incremented when a message from a failed post is buffered
+	// again, per Config.RecoverOnError.  The message is counted
+	// in Total once more when it is posted again.
+	Recovered uint64
+
+	// Incremented when a message body that is not valid UTF-8 is
+	// escaped, per Config.EscapePolicy.
+	EscapedMessages uint64
+
+	// Incremented when a message of a failed post is not written
+	// to Config.FallbackWriter, for it being too slow.  Such
+	// messages are counted in Cancelled or Rejected all the same.
+	FallbackSkipped uint64
+
 	// Request-level statistics
 
-	TotalRequests   uint64
+	// Number of bundles posted or dropped.
+	TotalPosts uint64
+
+	// Deprecated: the same as TotalPosts, under its old name.
+	TotalRequests uint64
+
 	DroppedRequests uint64
 	CancelRequests  uint64
 	RejectRequests  uint64
 	SuccessRequests uint64
+
+	// Breakdowns of requests by the reason they failed.
+	// CancelRequests are divided into TimeoutErrors, for
+	// requests that timed out, and NetworkErrors, for those that
+	// failed any other way.  RejectRequests are divided into
+	// AuthErrors (401 and 403), ClientErrors (any other 4xx),
+	// and ServerErrors (5xx); other statuses count in none.
+
+	NetworkErrors uint64
+	TimeoutErrors uint64
+	AuthErrors    uint64
+	ClientErrors  uint64
+	ServerErrors  uint64
+
+	// Byte-level statistics, for estimating billing by volume.
+	// Request bodies are not compressed, so these are the sizes
+	// of the bodies as they are, or would have been, sent.
+
+	CumulativeSuccessBytes uint64
+	CumulativeDropBytes    uint64
+
+	// Number of requests answered over HTTP/2.
+	HTTP2Requests uint64
+
+	// Number of posts to Config.FanoutLogplex endpoints that
+	// failed or were rejected.  These posts are not counted in
+	// any other statistic.
+	FanoutFailedRequests uint64
+
+	// Averages over the last minute of the rates at which
+	// messages are buffered and bundles of them are sent along
+	// (or dropped).
+	RecentMessagesPerSecond float64
+	RecentBundlesPerSecond  float64
+
+	// Mean duration in milliseconds of the requests counted in
+	// SuccessRequests, from sending the request to receiving the
+	// response headers.
+	MeanSuccessLatencyMs float64
+
+	// The mean time, in milliseconds, that Logplex took to start
+	// responding to posts after they had been sent in full,
+	// whatever the response.
+	AvgTTFBMillis float64
+
+	// The fraction of the errors allowed by
+	// Config.TargetSuccessRate that remain unspent, counting
+	// posts that failed or were rejected against those made: 1
+	// when none have failed, 0 when failures are exactly at the
+	// target, and negative once the target has been missed, at
+	// which point SLOViolated is set.  Both are zero when there is
+	// no target.
+	ErrorBudget float64
+	SLOViolated bool
+
+	// For TopSources.
+	topSources    [numTopSources]SourceStat
+	numTopSources int
 }
 
+// Returned when trying to use a Client that has been Closed, whether
+// by the program or because of Config.MaxIdleTime.
+var ErrClientClosed = errors.New("logplexc.Client: client already Closed")
+
 type TimeTriggerBehavior byte
 
 const (
@@ -58,17 +190,94 @@ const (
 	TimeTriggerNever
 )
 
+// The importance of a message, for filtering out the less important
+// ones before they are buffered.
+type LogLevel int
+
+const (
+	// The zero-value is the lowest level, so that the zero-value
+	// Config.MinLevel filters nothing.
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// What to drop when messages arrive faster than the workers can post
+// them.
+type DropPolicy byte
+
+const (
+	// The zero-value drops the bundle that no worker is free to
+	// post, which holds the newest messages.
+	DropPolicyDropNewest DropPolicy = iota
+
+	// Keep buffering while every worker is busy, dropping the
+	// oldest messages of the bundle to stay within the request
+	// size trigger.
+	DropPolicyDropOldest
+)
+
 type Client struct {
 	Stats
 	statLock sync.Mutex
 
+	// The number of posts averaged into Stats.AvgTTFBMillis.
+	ttfbSamples uint64
+
 	c *MiniClient
 
+	// Where to return c when closing, if anywhere.
+	miniClientPool *sync.Pool
+
+	// Set, atomically, once Close is done with c, which may then
+	// belong to another Client.  Statistics returns finalStats
+	// from then on, rather than consult c.
+	released   int32
+	finalStats Stats
+
+	// The Client this is a Clone of, if any, and the Clones of
+	// this Client, which share its workers and periodic flushing,
+	// until it closes them.
+	parent       *Client
+	clonesLock   sync.RWMutex
+	clones       map[*Client]struct{}
+	clonesClosed bool
+
+	// Messages below this level are filtered out.
+	minLevel LogLevel
+
+	// Messages older than this are not sent, if non-zero.
+	maxMessageAge time.Duration
+
 	// Concurrency control of POST workers: the current level of
 	// concurrency, and a token bucket channel.
 	concurrency int32
 	bucket      chan struct{}
 
+	// Number of bundles waiting on others to be posted first,
+	// accessed atomically.
+	queuedBundles int32
+
+	// Number of bundles handed to workers and not yet posted, and
+	// how many there may be before messages are dropped instead,
+	// per Config.MaxQueuedBundles.  pendingBundles is accessed
+	// atomically.
+	pendingBundles   int32
+	maxQueuedBundles int32
+
+	// For WaitIdle: idleChanged is closed and replaced whenever
+	// a worker or maybeWork finishes.
+	idleLock      sync.Mutex
+	idleChanged   chan struct{}
+	workersExited bool
+
+	// Recent history of concurrency, protected by statLock.
+	concurrencySamples concurrencySamples
+
+	// Recent history of throughput.
+	rateWindow rateWindow
+
 	// Threshold of logplex request size to trigger POST.
 	RequestSizeTrigger int
 
@@ -76,7 +285,110 @@ type Client struct {
 	timeTrigger TimeTriggerBehavior
 	ticker      *time.Ticker
 
+	// Closing after a period of inactivity, if non-zero.
+	// lastActivity is the UnixNano time of the latest buffering,
+	// accessed atomically.
+	maxIdleTime  time.Duration
+	lastActivity int64
+
+	// Called once closed, if non-nil.
+	onClose func()
+
+	// How long Close waits for posting to settle, if non-zero.
+	gracePeriod time.Duration
+
+	// Recognizer of repeated messages, if deduplicating.
+	dedupe *deduper
+
+	// Limit on the rate of buffering, if any.
+	limiter *rateLimiter
+
+	// Subscribers to snapshots of the statistics, see StatsChan.
+	statsChansLock   sync.Mutex
+	statsChans       []chan Stats
+	statsChansClosed bool
+
+	// Reconnecting after a run of failed posts, if
+	// maxConsecutiveErrors is non-zero.  consecutiveErrors is
+	// accessed atomically.
+	maxConsecutiveErrors int32
+	reconnectDelay       time.Duration
+	consecutiveErrors    int32
+
+	// Further Logplexes every bundle is posted to, with
+	// credentials.
+	fanout []url.URL
+
+	// Buffer again the messages of failed posts, once, up to
+	// maxRecoveryMessages of each if that is positive.
+	recoverOnError      bool
+	maxRecoveryMessages int
+
+	// How many times a message in a dropped bundle may be buffered
+	// again, if at all.
+	messageRetryBudget int
+
+	// Prefixing messages with their caller's position, at the
+	// given depth of runtime.Caller, if trackCallerInfo.
+	trackCallerInfo bool
+	callerSkip      int
+
+	// Prepended to every message body, with a space, if
+	// non-empty.
+	messagePrefix string
+
+	// What to do with message bodies that are not valid UTF-8.
+	escapePolicy EscapePolicy
+
+	// The fraction of posts meant to succeed, if non-zero.
+	targetSuccessRate float64
+
+	// The request size trigger, when it adapts to the success of
+	// posts; otherwise RequestSizeTrigger is used as it is.
+	adaptive *adaptiveTrigger
+
+	// How far past the trigger messages may accrue while every
+	// worker is busy, rather than be dropped.
+	secondaryBufferSize int
+
+	// Whether to drop the newest or the oldest messages when no
+	// worker is free.
+	dropPolicy DropPolicy
+
+	// Warns of a high drop rate, if requested.
+	dropWatch *dropWatch
+
+	// The volume of messages buffered from each host and procId,
+	// if requested.
+	sources *sourceTracker
+
+	// Receives the messages of failed posts, if requested.
+	fallback *fallbackWriter
+
+	// For logging diagnostics, if requested, and the Logplex URL
+	// to log them with, without its credentials.
+	slog         *slog.Logger
+	slogEndpoint string
+
+	// For posting bundles for any one procId in order, if
+	// requested: the done channel of the last bundle in line for
+	// each procId.
+	orderByProcId bool
+	orderLock     sync.Mutex
+	procIdTails   map[string]chan struct{}
+
+	// Set once Close begins, after which nothing more is
+	// buffered.  Buffering holds closeLock for reading, so that
+	// Close can be sure nobody is still adding to the final
+	// bundle once it holds closeLock itself.
+	closeLock sync.RWMutex
+	closing   bool
+
+	// The outcome of the final flush of Close.
+	closeErr error
+
 	// Closed when cleaning up
+	closeOnce    sync.Once
 	finalize     chan struct{}
 	finalizeDone sync.WaitGroup
 }
@@ -89,30 +401,467 @@ type Config struct {
 	Concurrency        int
 	Period             time.Duration
 
+	// Optional: a drain URL as Heroku shows it, to be parsed
+	// instead of setting Logplex.  It must be an https URL.  If
+	// Token is empty, it is taken from the password of the URL.
+	DrainURL string
+
 	// Optional: Can be set for advanced behaviors like triggering
 	// Never or Immediately.
 	TimeTrigger TimeTriggerBehavior
+
+	// Optional: messages with a level below MinLevel are
+	// discarded by BufferMessage.  The zero-value keeps
+	// everything.
+	MinLevel LogLevel
+
+	// Optional: when non-zero, messages that have grown older
+	// than MaxMessageAge by the time they are to be posted are
+	// discarded instead, as stale messages can do more to confuse
+	// than to inform.  Age is judged by the message timestamp.
+	MaxMessageAge time.Duration
+
+	// Optional: base64-encode hostnames that are not printable
+	// ASCII.  See MiniConfig.
+	EncodeHostAsBase64 bool
+
+	// Optional: derive each message's MSGID from its procId.  See
+	// MiniConfig.
+	MsgIDFromProcId bool
+
+	// Optional: write a line about every HTTP request and response
+	// to TraceWriter, or os.Stderr if TraceWriter is nil.  This is
+	// verbose, and meant for debugging connectivity to Logplex.
+	TraceHTTP   bool
+	TraceWriter io.Writer
+
+	// Optional: attempt HTTP/2, so that concurrent posts can
+	// share a connection.  This requires HttpClient.Transport to
+	// be nil or an *http.Transport, which is copied rather than
+	// modified.
+	UseHTTP2 bool
+
+	// Optional: the TLS configuration to post with, e.g. to trust
+	// the certificate authority of a private Logplex.  Like
+	// UseHTTP2, this requires HttpClient.Transport to be nil or
+	// an *http.Transport.
+	TLSConfig *tls.Config
+
+	// Optional: the hex-encoded SHA-256 digest of the DER
+	// encoding of the certificate Logplex must present.
+	// Connections to a server presenting any other certificate
+	// fail.  The certificate must still verify, so a self-signed
+	// certificate must also be trusted through TLSConfig.RootCAs.
+	PinnedCertSHA256 string
+
+	// Optional: the server name to verify Logplex's certificate
+	// against and to send for SNI, instead of the host of the
+	// Logplex URL.  This is for when Logplex is reached by an IP
+	// address, or through a name its certificate does not cover.
+	LogplexTLSServerName string
+
+	// Optional: the path of a Unix socket on which a local agent
+	// serves HTTP, to connect to instead of the host of the
+	// Logplex URL.  Requests are otherwise unchanged, so the URL
+	// still determines the Host header and path the agent sees.
+	LocalAgent string
+
+	// Optional: when non-zero, a post fails with a timeout if
+	// sending the request, from having a connection until the
+	// whole body is written, takes longer than WriteTimeout.  It
+	// is independent of HttpClient.Timeout, which bounds the
+	// whole exchange, so that a network too slow to send over
+	// can be told apart from a Logplex slow to respond.
+	WriteTimeout time.Duration
+
+	// Optional: when non-zero, a post fails with a timeout if
+	// Logplex takes longer than ResponseTimeout, from when the
+	// whole request has been sent, to start responding.  Like
+	// WriteTimeout, it is independent of HttpClient.Timeout.
+	ResponseTimeout time.Duration
+
+	// Optional: tuning of connection reuse.  MaxIdleConns bounds
+	// the idle connections kept for reuse, in total and to
+	// Logplex alone; net/http otherwise keeps only two per host,
+	// fewer than the workers of a Client with a high Concurrency,
+	// so that some posts pay for a new TLS handshake.
+	// IdleConnTimeout is how long an idle connection is kept.
+	// DisableKeepAlives makes every post use a new connection.
+	// Like UseHTTP2, these require HttpClient.Transport to be nil
+	// or an *http.Transport.
+	MaxIdleConns      int
+	IdleConnTimeout   time.Duration
+	DisableKeepAlives bool
+
+	// Optional: a cache of MiniClients, for programs that create
+	// and Close many short-lived Clients.  NewClient borrows a
+	// MiniClient from the pool if one there posts to the same
+	// Logplex URL with the same Token, and Close puts it back.
+	// One that posts elsewhere is left in the pool, but only the
+	// first one NewClient gets from it is looked at, so a pool is
+	// best shared by Clients that post to the same place.
+	//
+	// A borrowed MiniClient keeps the HTTP client it was created
+	// with, so Clients sharing a pool should agree on the HTTP
+	// options.
+	MiniClientPool *sync.Pool
+
+	// Optional: when non-zero, the Client closes itself with
+	// GracefulClose once MaxIdleTime passes without a message
+	// being buffered.
+	MaxIdleTime time.Duration
+
+	// Optional: called once the Client has closed, whether by
+	// Close, GracefulClose, or MaxIdleTime.
+	OnClose func()
+
+	// Optional: post the bundles containing messages for any one
+	// procId one at a time, in the order they were buffered, so
+	// that concurrent posts cannot reorder a procId's messages.
+	// Bundles that share no procId may still be posted
+	// concurrently, within the bounds of Concurrency.
+	OrderByProcId bool
+
+	// Optional: static headers added to every post.  See
+	// MiniConfig.
+	RequestMetadata map[string]string
+	CustomHeaders   map[string]string
+
+	// Optional: when non-zero, once MaxConsecutiveErrors posts in
+	// a row have failed without a response, idle HTTP connections
+	// are closed and posting pauses for ReconnectDelay, so that
+	// the next post dials afresh rather than reusing a connection
+	// that went stale during an outage.  Any response resets the
+	// count.
+	MaxConsecutiveErrors int
+	ReconnectDelay       time.Duration
+
+	// Optional: further Logplex URLs that every bundle is also
+	// posted to, with the same Token unless a URL has its own
+	// credentials.  Each is posted to independently of the
+	// others, concurrently with the post to Logplex, and their
+	// outcomes only affect FanoutFailedRequests.
+	FanoutLogplex []url.URL
+
+	// Optional: buffer the messages of a post that fails or is
+	// rejected again, to be posted along with later messages.
+	// Each message is given only this one second chance, so that
+	// a persistently failing Logplex cannot keep messages
+	// circulating forever.  Recovered messages are posted after
+	// those buffered in the meantime.
+	RecoverOnError bool
+
+	// Optional: with RecoverOnError, buffer no more than this
+	// many messages of each failed post again, the earliest
+	// first.  The rest are counted in Stats.Dropped, rather than
+	// in Stats.Cancelled or Stats.Rejected.  Zero means no
+	// limit.
+	MaxRecoveryMessages int
+
+	// Optional: when non-zero, Close first waits up to
+	// GracePeriod for posts in progress to finish and, when
+	// flushing periodically, for the next flush to take what has
+	// been buffered, before making its own final flush.  This
+	// suits runtimes that stop a program as soon as it returns.
+	GracePeriod time.Duration
+
+	// Optional: Close the Client, as GracefulClose does, when
+	// the program receives any of these signals, e.g.
+	// syscall.SIGTERM, with which Kubernetes asks a program to
+	// stop.  Once the Client is closed, or ShutdownTimeout has
+	// passed if non-zero, the signal is delivered again: unless
+	// the program handles it itself, it then has its usual
+	// effect, such as terminating the program.
+	FlushOnShutdownSignal []os.Signal
+	ShutdownTimeout       time.Duration
+
+	// Optional: when non-zero, a message with the same host,
+	// procId and body as one buffered less than DedupeWindow ago
+	// is discarded, e.g. to cut down on repetitive health check
+	// logging.  Messages are recognized by hash, and only the
+	// DedupeMaxEntries (by default 1024) most recently seen are
+	// remembered.
+	DedupeWindow     time.Duration
+	DedupeMaxEntries int
+
+	// Optional: when positive, buffer no more than
+	// MaxMessagesPerSecond messages a second on average, with
+	// bursts of up to RateLimitBurst (at least 1) messages,
+	// e.g. to stay within a Logplex drain's rate limit.  Messages
+	// over the limit are not waited on, but discarded and
+	// counted in Stats.Total and Stats.Dropped.
+	MaxMessagesPerSecond float64
+	RateLimitBurst       int
+
+	// Optional: when positive, the messages of a bundle that is
+	// dropped for want of a free worker are buffered again to be
+	// sent with later messages, up to MessageRetryBudget times
+	// each.  Only messages that have used up their budget count in
+	// Stats.Dropped.  Re-buffering after a failed post, per
+	// RecoverOnError, uses up the same budget.
+	MessageRetryBudget int
+
+	// Optional: prefix each message passed to BufferMessage with
+	// the file and line it was buffered from, as in
+	// "caller=main.go:42 ", for debugging.  This costs a call to
+	// runtime.Caller per message.  CallerSkip is the depth passed
+	// to runtime.Caller, and defaults to 2, for calls made
+	// directly to BufferMessage; a program that buffers through
+	// wrappers of its own adds one for each.
+	TrackCallerInfo bool
+	CallerSkip      int
+
+	// Optional: a tag, such as "[staging]", prepended with a
+	// space to the body of every message buffered.
+	MessagePrefix string
+
+	// Optional: how to escape message bodies that are not valid
+	// UTF-8, such as binary payloads, before they are framed.
+	// By default they are framed as they are.
+	EscapePolicy EscapePolicy
+
+	// Optional: the fraction of posts, between 0 and 1, meant to
+	// succeed, e.g. 0.999.  It is the basis of Stats.ErrorBudget.
+	TargetSuccessRate float64
+
+	// Optional: adapt the request size trigger to how many of the
+	// last 100 posts have succeeded, reconsidering every 10
+	// posts.  Starting from RequestSizeTrigger, it is halved
+	// (down to 512 bytes) while fewer than half succeed, to post
+	// smaller bundles sooner, and grown by a tenth (up to
+	// MaxRequestSizeTrigger, by default RequestSizeTrigger) while
+	// more than nine in ten do.  The Client's RequestSizeTrigger
+	// field is then not consulted.
+	AdaptiveBatchSize     bool
+	MaxRequestSizeTrigger int
+
+	// Optional: when every worker is busy posting, keep
+	// buffering instead of swapping out a bundle that would only
+	// be dropped, until SecondaryBufferSize bytes past the
+	// request size trigger have accrued.  What has been held back
+	// is posted as soon as a worker is free.
+	SecondaryBufferSize int
+
+	// Optional: which messages to drop when every worker is busy
+	// posting.  By default the bundle that could not be posted,
+	// holding the newest messages, is dropped.  With
+	// DropPolicyDropOldest, the bundle keeps buffering and its
+	// oldest messages are dropped to stay within the request size
+	// trigger, to be posted as soon as a worker is free.
+	DropPolicy DropPolicy
+
+	// Optional: when non-zero, log a warning to Logger once more
+	// than this fraction, between 0 and 1, of the messages of the
+	// last minute have been dropped, repeated at most once every
+	// DropWarnCooldown (by default, a minute) while that lasts.
+	// Another line is logged once the drop rate is back within
+	// DropWarnThreshold.  Logger defaults to the standard logger.
+	DropWarnThreshold float64
+	DropWarnCooldown  time.Duration
+	Logger            *log.Logger
+
+	// Optional: when non-zero, drop messages per DropPolicy as
+	// soon as this many bundles are being posted, rather than
+	// hand another bundle to a worker, bounding the memory held
+	// by bundles in flight to fewer than Concurrency of them.
+	MaxQueuedBundles int
+
+	// Optional: where to write the messages of posts that failed
+	// or were rejected, one syslog line each, rather than to
+	// lose them.  Messages buffered again per RecoverOnError are
+	// not written until they are given up on.  A write that is
+	// not done within FallbackWriteTimeout (by default, 100ms)
+	// is abandoned, and the messages of further posts are skipped
+	// until it is done.
+	FallbackWriter       io.Writer
+	FallbackWriteTimeout time.Duration
+
+	// Optional: where to log what the Client itself is doing:
+	// each post at LevelDebug, posts that fail or are rejected
+	// and reconnections per MaxConsecutiveErrors at LevelWarn,
+	// and the final Statistics on Close at LevelInfo.  By
+	// default nothing is logged.
+	SlogLogger *slog.Logger
+
+	// Optional: count the messages buffered from each host and
+	// procId, for TopSources.  Off by default, as it costs a
+	// little on every message buffered.
+	TrackSources bool
+}
+
+// Borrow a MiniClient from cfg.MiniClientPool that is fit to serve
+// cfg: one that posts to the same place with the same credentials,
+// and has nothing left buffered.  One that posts elsewhere is put
+// back for a Client it does suit; anything else unfit is discarded.
+func borrowMiniClient(cfg *Config) *MiniClient {
+	if cfg.MiniClientPool == nil {
+		return nil
+	}
+
+	c, ok := cfg.MiniClientPool.Get().(*MiniClient)
+	if !ok || c.Statistics().NumberFramed != 0 {
+		return nil
+	}
+
+	want := withCredentials(cfg.Logplex, cfg.Token)
+	if c.Token != cfg.Token || c.Logplex.String() != want.String() {
+		cfg.MiniClientPool.Put(c)
+		return nil
+	}
+
+	c.EncodeHostAsBase64 = cfg.EncodeHostAsBase64
+	c.MsgIDFromProcId = cfg.MsgIDFromProcId
+	c.RequestMetadata = cfg.RequestMetadata
+	c.CustomHeaders = cfg.CustomHeaders
+	c.headers = staticHeaders(c.RequestMetadata, c.CustomHeaders)
+
+	return c
 }
 
 func NewClient(cfg *Config) (*Client, error) {
-	c, err := NewMiniClient(
-		&MiniConfig{
-			Logplex:    cfg.Logplex,
-			Token:      cfg.Token,
-			HttpClient: cfg.HttpClient,
-		})
+	return newClient(cfg, nil)
+}
 
+// Create a Client, sharing the workers and periodic flushing of
+// parent if it is not nil.
+func newClient(cfg *Config, parent *Client) (*Client, error) {
+	cfg, err := resolveDrainURL(cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := validateToken(cfg.Token); err != nil {
+		return nil, err
+	}
+
+	if parent == nil && cfg.Concurrency < 0 {
+		return nil, errors.New(
+			"logplexc.Client: negative concurrency not allowed")
+	}
+
+	if cfg.DropWarnThreshold < 0 || cfg.DropWarnThreshold > 1 {
+		return nil, errors.New("logplexc.Client: drop warning " +
+			"threshold must be between 0 and 1")
+	}
+
+	if cfg.TargetSuccessRate < 0 || cfg.TargetSuccessRate > 1 {
+		return nil, errors.New("logplexc.Client: target success " +
+			"rate must be between 0 and 1")
+	}
+
+	c := borrowMiniClient(cfg)
+	if c == nil {
+		httpClient, err := configureHttpClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err = NewMiniClient(
+			&MiniConfig{
+				Logplex:    cfg.Logplex,
+				Token:      cfg.Token,
+				HttpClient: httpClient,
+				BundlePool: NewBundlePool(cfg.RequestSizeTrigger),
+
+				EncodeHostAsBase64: cfg.EncodeHostAsBase64,
+				MsgIDFromProcId:    cfg.MsgIDFromProcId,
+				RequestMetadata:    cfg.RequestMetadata,
+				CustomHeaders:      cfg.CustomHeaders,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	m := Client{
 		c:                  c,
+		miniClientPool:     cfg.MiniClientPool,
 		finalize:           make(chan struct{}),
-		bucket:             make(chan struct{}),
+		idleChanged:        make(chan struct{}),
 		RequestSizeTrigger: cfg.RequestSizeTrigger,
+		minLevel:           cfg.MinLevel,
+		maxMessageAge:      cfg.MaxMessageAge,
+		maxIdleTime:        cfg.MaxIdleTime,
+		onClose:            cfg.OnClose,
+		orderByProcId:      cfg.OrderByProcId,
+		procIdTails:        make(map[string]chan struct{}),
+
+		maxConsecutiveErrors: int32(cfg.MaxConsecutiveErrors),
+		reconnectDelay:       cfg.ReconnectDelay,
+		recoverOnError:       cfg.RecoverOnError,
+		maxRecoveryMessages:  cfg.MaxRecoveryMessages,
+		gracePeriod:          cfg.GracePeriod,
+		messageRetryBudget:   cfg.MessageRetryBudget,
+		trackCallerInfo:      cfg.TrackCallerInfo,
+		callerSkip:           cfg.CallerSkip,
+		messagePrefix:        cfg.MessagePrefix,
+		escapePolicy:         cfg.EscapePolicy,
+		targetSuccessRate:    cfg.TargetSuccessRate,
+		secondaryBufferSize:  cfg.SecondaryBufferSize,
+		dropPolicy:           cfg.DropPolicy,
+		maxQueuedBundles:     int32(cfg.MaxQueuedBundles),
+	}
+
+	if cfg.TrackSources {
+		m.sources = newSourceTracker(maxTrackedSources)
+	}
+
+	if m.callerSkip == 0 {
+		m.callerSkip = 2
 	}
 
+	for _, u := range cfg.FanoutLogplex {
+		m.fanout = append(m.fanout, withCredentials(u, cfg.Token))
+	}
+
+	if cfg.AdaptiveBatchSize {
+		m.adaptive = newAdaptiveTrigger(cfg.RequestSizeTrigger,
+			cfg.MaxRequestSizeTrigger)
+	}
+
+	if cfg.DedupeWindow > 0 {
+		m.dedupe = newDeduper(cfg.DedupeWindow, cfg.DedupeMaxEntries)
+	}
+
+	if cfg.DropWarnThreshold > 0 {
+		endpoint := withCredentials(cfg.Logplex, cfg.Token)
+		m.dropWatch = newDropWatch(cfg.DropWarnThreshold,
+			cfg.DropWarnCooldown, cfg.Logger, endpoint.Redacted())
+	}
+
+	if cfg.FallbackWriter != nil {
+		m.fallback = newFallbackWriter(cfg.FallbackWriter,
+			cfg.FallbackWriteTimeout)
+	}
+
+	if cfg.SlogLogger != nil {
+		endpoint := withCredentials(cfg.Logplex, cfg.Token)
+		m.slog = cfg.SlogLogger
+		m.slogEndpoint = endpoint.Redacted()
+	}
+
+	if cfg.MaxMessagesPerSecond > 0 {
+		m.limiter = newRateLimiter(cfg.MaxMessagesPerSecond,
+			cfg.RateLimitBurst)
+	}
+
+	if parent != nil {
+		m.parent = parent
+		m.bucket = parent.bucket
+		m.timeTrigger = parent.timeTrigger
+		m.startBackground()
+
+		if err := parent.addClone(&m); err != nil {
+			m.Close()
+			return nil, err
+		}
+
+		return &m, nil
+	}
+
+	m.bucket = make(chan struct{}, cfg.Concurrency)
+
 	// Handle determining m.timeTrigger.  This complexity seems
 	// reasonable to allow the user to get some input checking
 	// (negative Periods) and to get TimeTriggerImmediate by
@@ -137,23 +886,22 @@ func NewClient(cfg *Config) (*Client, error) {
 		m.timeTrigger = cfg.TimeTrigger
 	}
 
-	// Supply tokens to the buckets.
+	// Supply tokens to the bucket.
 	//
-	// This goroutine exits when it has supplied all of the
-	// initial tokens: that's because worker goroutines are
+	// The bucket is filled up front so that work is never
+	// dropped merely because nobody had yet gotten around to
+	// supplying a token; after this, worker goroutines are
 	// responsible for re-inserting tokens.
-	m.finalizeDone.Add(1)
-	go func() {
-		defer func() { m.finalizeDone.Done() }()
+	for i := 0; i < cfg.Concurrency; i += 1 {
+		m.bucket <- struct{}{}
+	}
 
-		for i := 0; i < cfg.Concurrency; i += 1 {
-			select {
-			case m.bucket <- struct{}{}:
-			case <-m.finalize:
-				return
-			}
-		}
-	}()
+	m.startBackground()
+
+	if len(cfg.FlushOnShutdownSignal) > 0 {
+		m.closeOnSignal(cfg.FlushOnShutdownSignal,
+			cfg.ShutdownTimeout)
+	}
 
 	// Set up the time-based log flushing, if requested.
 	if m.timeTrigger == TimeTriggerPeriodic {
@@ -173,6 +921,7 @@ func NewClient(cfg *Config) (*Client, error) {
 				}
 
 				m.maybeWork()
+				m.eachClone((*Client).maybeWork)
 			}
 		}()
 	}
@@ -180,131 +929,861 @@ func NewClient(cfg *Config) (*Client, error) {
 	return &m, nil
 }
 
+// Start the goroutines that keep statistics and, if requested, watch
+// for idleness.
+func (m *Client) startBackground() {
+	m.rateWindow.curStart = time.Now()
+	m.finalizeDone.Add(2)
+	go m.sampleConcurrency()
+	go m.tickRateWindow()
+
+	if m.maxIdleTime > 0 {
+		m.touch()
+
+		m.finalizeDone.Add(1)
+		go m.watchIdle()
+	}
+}
+
+// Stop the Client, waiting for its goroutines to exit.  Messages that
+// have been buffered but not yet posted are flushed first, and
+// buffering fails with ErrClientClosed from the time Close begins.
+//
+// Closing more than once is harmless.
 func (m *Client) Close() {
+	m.closeOnce.Do(m.close)
+}
+
+func (m *Client) close() {
+	m.unregisterAll()
+
+	if m.parent != nil {
+		m.parent.removeClone(m)
+	}
+
+	m.closeClones()
+
+	m.closeLock.Lock()
+	m.closing = true
+	m.closeLock.Unlock()
+
+	if m.gracePeriod > 0 {
+		m.waitSettled(m.gracePeriod)
+	}
+
+	m.closeErr = m.Flush()
+
 	// Clean up otherwise immortal ticker goroutine
-	m.ticker.Stop()
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
+
 	close(m.finalize)
 	m.finalizeDone.Wait()
+
+	if m.fallback != nil {
+		m.fallback.wait()
+	}
+	m.signalWorkersExited()
+	m.closeStatsChans()
+
+	// Take the last Statistics while c is still this Client's.
+	m.finalStats = m.Statistics()
+	atomic.StoreInt32(&m.released, 1)
+
+	if m.onClose != nil {
+		m.onClose()
+	}
+
+	if m.miniClientPool != nil {
+		// Discard anything left unsent, so the MiniClient is
+		// fit for re-use.
+		m.c.ReleaseBundle(m.c.SwapBundle())
+		m.miniClientPool.Put(m.c)
+	}
+
+	m.logClosed(m.finalStats)
 }
 
-func (m *Client) BufferMessage(
-	when time.Time, host string, procId string, log []byte) error {
+// Wait, for no longer than timeout, until no posts are in progress
+// and nothing is buffered that a periodic flush would yet post.
+func (m *Client) waitSettled(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		settled := len(m.bucket) == cap(m.bucket)
+		if m.timeTrigger == TimeTriggerPeriodic {
+			settled = settled && m.c.Statistics().NumberFramed == 0
+		}
+
+		if settled {
+			return
+		}
+
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// Close, returning the outcome of the final flush.
+func (m *Client) GracefulClose() error {
+	m.Close()
+	return m.closeErr
+}
 
+// Record activity, to put off closing for MaxIdleTime.
+func (m *Client) touch() {
+	atomic.StoreInt64(&m.lastActivity, time.Now().UnixNano())
+}
+
+// Close the Client once it has been idle for MaxIdleTime.
+func (m *Client) watchIdle() {
+	defer func() { m.finalizeDone.Done() }()
+
+	t := time.NewTimer(m.maxIdleTime)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-m.finalize:
+			return
+		}
+
+		last := time.Unix(0, atomic.LoadInt64(&m.lastActivity))
+		idle := time.Since(last)
+		if idle >= m.maxIdleTime {
+			// Closing waits for this goroutine to exit, so
+			// it has to be done from another.
+			go m.GracefulClose()
+			return
+		}
+
+		t.Reset(m.maxIdleTime - idle)
+	}
+}
+
+// Whether Close has been called.
+func (m *Client) closed() bool {
 	select {
 	case <-m.finalize:
-		return errors.New("Failed trying to buffer a message: " +
-			"client already Closed")
+		return true
 	default:
-		// no-op
+		return false
+	}
+}
+
+// Buffer a message for delivery to Logplex, unless its level is below
+// Config.MinLevel, in which case it is counted in Stats.Filtered and
+// otherwise ignored.
+func (m *Client) BufferMessage(level LogLevel,
+	when time.Time, host string, procId string, log []byte) error {
+	m.closeLock.RLock()
+	defer m.closeLock.RUnlock()
+
+	if m.closing {
+		return ErrClientClosed
+	}
+
+	if m.maxIdleTime > 0 {
+		m.touch()
+	}
+
+	if level < m.minLevel {
+		m.statFiltered(1)
+		return nil
+	}
+
+	now := time.Now()
+	hash, dup := m.dedupe.duplicate(now, host, procId, log)
+	if dup {
+		m.statDeduped(1)
+		return nil
+	}
+
+	if !m.limiter.allow(now) {
+		m.statRateLimited(1)
+		return nil
+	}
+
+	m.dedupe.record(now, hash)
+
+	if escaped, ok := escapeMessage(m.escapePolicy, log); ok {
+		log = escaped
+		m.statEscaped(1)
+	}
+
+	if m.trackCallerInfo {
+		log = m.withCallerInfo(log)
+	}
+
+	if m.messagePrefix != "" {
+		log = m.withMessagePrefix(log)
 	}
 
 	s := m.c.BufferMessage(when, host, procId, log)
-	if s.Buffered >= m.RequestSizeTrigger ||
+	m.rateWindow.countMessages(1)
+	m.sources.count(host, procId, len(log))
+	if s.Buffered >= m.sizeTrigger() ||
 		m.timeTrigger == TimeTriggerImmediate {
-		m.maybeWork()
+		if m.queueFull() {
+			m.dropBuffered()
+		} else {
+			m.maybeWork()
+		}
 	}
 
 	return nil
 }
 
+// Prefix a message with the position of the caller of
+// BufferMessage.  This must be called directly from BufferMessage
+// for callerSkip to count from the right place.
+func (m *Client) withCallerInfo(log []byte) []byte {
+	_, file, line, ok := runtime.Caller(m.callerSkip)
+	if !ok {
+		return log
+	}
+
+	prefix := "caller=" + filepath.Base(file) + ":" +
+		strconv.Itoa(line) + " "
+	return append([]byte(prefix), log...)
+}
+
+// Prefix a message with Config.MessagePrefix, leaving the original
+// as it is.
+func (m *Client) withMessagePrefix(log []byte) []byte {
+	prefixed := make([]byte, 0, len(m.messagePrefix)+1+len(log))
+	prefixed = append(prefixed, m.messagePrefix...)
+	prefixed = append(prefixed, ' ')
+	return append(prefixed, log...)
+}
+
+// A log message, carrying the arguments of BufferMessage.
+type LogMessage struct {
+	Level  LogLevel
+	When   time.Time
+	Host   string
+	ProcId string
+	Log    []byte
+}
+
+// The arguments of a BufferMessage call, for BulkBufferMessages.
+type LogEntry = LogMessage
+
+// Buffer many messages at once, as BufferMessage would each of them,
+// but with the cost of synchronization amortized across the batch.
+//
+// The number of messages buffered is returned, which falls short of
+// len(msgs) by the number filtered for being below Config.MinLevel,
+// discarded as duplicates, or over the rate limit.
+func (m *Client) BulkBufferMessages(
+	msgs []LogEntry) (buffered int, err error) {
+	m.closeLock.RLock()
+	defer m.closeLock.RUnlock()
+
+	if m.closing {
+		return 0, ErrClientClosed
+	}
+
+	if m.maxIdleTime > 0 {
+		m.touch()
+	}
+
+	kept := msgs
+	if m.minLevel > LevelDebug || m.dedupe != nil ||
+		m.limiter != nil || m.messagePrefix != "" ||
+		m.escapePolicy != EscapeNone {
+		var filtered, deduped, limited, escaped uint64
+		now := time.Now()
+
+		kept = make([]LogEntry, 0, len(msgs))
+		for i := range msgs {
+			if msgs[i].Level < m.minLevel {
+				filtered += 1
+				continue
+			}
+
+			hash, dup := m.dedupe.duplicate(now, msgs[i].Host,
+				msgs[i].ProcId, msgs[i].Log)
+			if dup {
+				deduped += 1
+				continue
+			}
+
+			if !m.limiter.allow(now) {
+				limited += 1
+				continue
+			}
+
+			m.dedupe.record(now, hash)
+
+			// Copy, so as not to modify msgs.
+			e := msgs[i]
+			if log, ok := escapeMessage(m.escapePolicy,
+				e.Log); ok {
+				e.Log = log
+				escaped += 1
+			}
+
+			if m.messagePrefix != "" {
+				e.Log = m.withMessagePrefix(e.Log)
+			}
+
+			kept = append(kept, e)
+		}
+
+		if filtered > 0 {
+			m.statFiltered(filtered)
+		}
+
+		if deduped > 0 {
+			m.statDeduped(deduped)
+		}
+
+		if limited > 0 {
+			m.statRateLimited(limited)
+		}
+
+		if escaped > 0 {
+			m.statEscaped(escaped)
+		}
+	}
+
+	if len(kept) == 0 {
+		return 0, nil
+	}
+
+	s := m.c.BufferMessages(kept)
+	m.rateWindow.countMessages(uint64(len(kept)))
+	m.sources.countAll(kept)
+	if s.Buffered >= m.sizeTrigger() ||
+		m.timeTrigger == TimeTriggerImmediate {
+		if m.queueFull() {
+			m.dropBuffered()
+		} else {
+			m.maybeWork()
+		}
+	}
+
+	return len(kept), nil
+}
+
+// Get a channel through which messages can be buffered, for programs
+// that are organized as pipelines.
+//
+// Each message sent is handed to BufferMessage by a goroutine private
+// to the channel.  The caller closes the channel to signal the end of
+// input, whereupon the messages buffered so far are sent along to
+// logplex.  Messages sent after the Client is Closed are discarded.
+func (m *Client) InputChan(bufsize int) chan<- LogMessage {
+	ch := make(chan LogMessage, bufsize)
+
+	// Keep senders to a closed Client from blocking forever.
+	drain := func() {
+		for range ch {
+		}
+	}
+
+	select {
+	case <-m.finalize:
+		go drain()
+		return ch
+	default:
+		// no-op
+	}
+
+	m.finalizeDone.Add(1)
+	go func() {
+		defer func() { m.finalizeDone.Done() }()
+
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					// End of input: flush, whether or
+					// not a worker is free.
+					m.Flush()
+					return
+				}
+
+				m.BufferMessage(msg.Level, msg.When,
+					msg.Host, msg.ProcId, msg.Log)
+			case <-m.finalize:
+				go drain()
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Post the messages buffered so far and wait for the outcome.
+//
+// This is MiniClient.Drain with the outcome accrued to Statistics:
+// the post is made by the caller's goroutine and does not need, nor
+// use, one of the Client's concurrency tokens.
+func (m *Client) Flush() error {
+	if m.closed() {
+		return ErrClientClosed
+	}
+
+	// Hold the ordering of posts still until the bundle has its
+	// place in line, or turns out to be empty.
+	m.lockOrder()
+	locked := true
+	unlock := func() {
+		if locked {
+			locked = false
+			m.unlockOrder()
+		}
+	}
+	defer unlock()
+
+	return m.c.drain(func(b *Bundle) error {
+		o := m.enqueueOrdered(b)
+		unlock()
+
+		defer m.finishOrdered(o)
+
+		m.rateWindow.countBundle()
+
+		m.waitOrdered(o)
+		return m.post(b)
+	})
+}
+
 func (m *Client) Statistics() (s Stats) {
+	if atomic.LoadInt32(&m.released) != 0 {
+		return m.finalStats
+	}
+
+	// Gathered before taking statLock, which every post needs.
+	id := m.c.currentBundleID()
+	var top [numTopSources]SourceStat
+	numTop := m.sources.top(&top)
+
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
 
 	s = m.Stats
+	s.CurrentBundleID = id
+	s.topSources, s.numTopSources = top, numTop
+	s.Concurrency = m.currentConcurrency()
+	s.BundleQueueDepth = int(atomic.LoadInt32(&m.queuedBundles))
+	s.QueueDepth = atomic.LoadInt32(&m.pendingBundles)
+	s.ConcurrencyP95 = m.concurrencySamples.percentile(0.95)
+	s.RecentMessagesPerSecond, s.RecentBundlesPerSecond =
+		m.rateWindow.rates(time.Now())
+
+	if m.targetSuccessRate > 0 {
+		s.ErrorBudget = errorBudget(m.targetSuccessRate, &s)
+		s.SLOViolated = s.ErrorBudget < 0
+	}
+
 	return s
 }
 
+// Work out the fraction of the errors allowed by target that have
+// not been spent.
+func errorBudget(target float64, s *Stats) float64 {
+	failed := float64(s.CancelRequests + s.RejectRequests)
+	posted := failed + float64(s.SuccessRequests)
+	allowed := (1 - target) * posted
+
+	if allowed == 0 {
+		// Either nothing has been posted, or no failure at
+		// all is allowed.
+		if failed == 0 {
+			return 1
+		}
+
+		return -1
+	}
+
+	return (allowed - failed) / allowed
+}
+
+func (m *Client) currentConcurrency() int32 {
+	return atomic.LoadInt32(&m.concurrency)
+}
+
 func (m *Client) maybeWork() {
-	atomic.AddInt32(&m.Stats.Concurrency, 1)
-	defer atomic.AddInt32(&m.Stats.Concurrency, -1)
+	if m.holdBack() {
+		return
+	}
+
+	atomic.AddInt32(&m.concurrency, 1)
+	defer func() {
+		atomic.AddInt32(&m.concurrency, -1)
+		m.signalIdle()
+	}()
+
+	// Check if there are any worker tokens available.
+	token := false
+	select {
+	case <-m.bucket:
+		token = true
+	default:
+	}
+
+	if token && m.queueFull() {
+		m.bucket <- struct{}{}
+		token = false
+	}
+
+	if !token && m.dropPolicy == DropPolicyDropOldest {
+		// Keep the bundle, and the newest messages in it, for
+		// when a worker is free.
+		m.dropOldest()
+		return
+	}
+
+	// Hold the ordering of posts still until this bundle has
+	// its place in line, if it gets one.
+	m.lockOrder()
+	defer m.unlockOrder()
 
 	b := m.c.SwapBundle()
 
 	// Avoid sending empty requests
 	if b.NumberFramed <= 0 {
+		m.c.ReleaseBundle(b)
+		if token {
+			m.bucket <- struct{}{}
+		}
+
 		return
 	}
 
-	// Check if there are any worker tokens available. If not,
-	// then just abort after recording drop statistics.
-	select {
-	case <-m.bucket:
+	m.rateWindow.countBundle()
+
+	// Without a token, just abort after recording drop
+	// statistics.
+	if token {
+		atomic.AddInt32(&m.pendingBundles, 1)
 		m.finalizeDone.Add(1)
-		go m.syncWorker(&b)
+		go m.syncWorker(b, m.enqueueOrdered(b))
+	} else {
+		m.dropBundle(b)
+	}
+}
 
-	default:
-		m.statReqDrop(&b.MiniStats)
+// Drop a bundle that no worker is free to post, recording drop
+// statistics.
+func (m *Client) dropBundle(b *Bundle) {
+	dropped := b.MiniStats
+	if m.messageRetryBudget > 0 {
+		// Give the messages with retries left another go in
+		// the next bundle.
+		moved := m.c.rebuffer(b, func(attempts int) bool {
+			return attempts < m.messageRetryBudget
+		})
 
-		// In GOMAXPROCS=1 cases, tight loops can starve out
-		// any of the workers predictably and seemingly
-		// forever.
-		runtime.Gosched()
+		dropped.NumberFramed -= moved.NumberFramed
+		dropped.Buffered -= moved.Buffered
 	}
+
+	m.statReqDrop(&dropped)
+	m.c.ReleaseBundle(b)
+
+	// In GOMAXPROCS=1 cases, tight loops can starve out any of
+	// the workers predictably and seemingly forever.
+	runtime.Gosched()
 }
 
-func (m *Client) syncWorker(b *Bundle) {
+// Drop the oldest messages buffered so far until what is left fits
+// within the request size trigger, per Config.DropPolicy.
+func (m *Client) dropOldest() {
+	dropped := m.c.trimTo(m.sizeTrigger())
+	if dropped.NumberFramed > 0 {
+		m.statTrimmed(&dropped)
+	}
+}
+
+// Whether to leave the messages buffered so far where they are, per
+// Config.SecondaryBufferSize, because no worker is free to post them
+// and there is room to hold them.
+func (m *Client) holdBack() bool {
+	if m.secondaryBufferSize <= 0 || len(m.bucket) > 0 {
+		return false
+	}
+
+	limit := m.sizeTrigger() + m.secondaryBufferSize
+	return m.c.Statistics().Buffered < limit
+}
+
+// Post the messages held back while workers were busy, if any would
+// have been posted by now.
+func (m *Client) postHeldBack() {
+	if m.secondaryBufferSize <= 0 &&
+		m.dropPolicy != DropPolicyDropOldest {
+		return
+	}
+
+	s := m.c.Statistics()
+	if s.NumberFramed > 0 && (s.Buffered >= m.sizeTrigger() ||
+		m.timeTrigger == TimeTriggerImmediate) {
+		m.maybeWork()
+	}
+}
+
+func (m *Client) syncWorker(b *Bundle, o *postOrder) {
 	defer func() { m.finalizeDone.Done() }()
+	defer m.c.ReleaseBundle(b)
 
 	// When exiting, free up the token for use by another
-	// worker.
+	// worker.  The bucket has room for every token, so this
+	// never blocks, and must happen even when shutting down: a
+	// clone's tokens are its parent's, which outlives it.
 	defer func() {
-		select {
-		case m.bucket <- struct{}{}:
-			// Made token available.
-		case <-m.finalize:
-			// Client is shutting down, allow termination
-			// from the closed finalize.
+		m.bucket <- struct{}{}
+
+		// The token may be awaited by messages held back,
+		// unless the Client is shutting down.
+		if !m.closed() {
+			m.postHeldBack()
+		}
+
+		m.signalIdle()
+		if m.parent != nil {
+			m.parent.signalIdle()
 		}
 	}()
 
-	// Post to logplex.
-	resp, err := m.c.Post(b)
+	defer m.finishOrdered(o)
+	m.waitOrdered(o)
+
+	m.post(b)
+	atomic.AddInt32(&m.pendingBundles, -1)
+}
+
+// Post a bundle to logplex and accrue statistics on the outcome.
+func (m *Client) post(b *Bundle) error {
+	if m.maxMessageAge > 0 {
+		m.dropStale(b)
+
+		// Skip posting if nothing is left to post.
+		if b.NumberFramed == 0 {
+			return nil
+		}
+	}
+
+	defer m.publishStats()
+
+	if len(m.fanout) > 0 {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		m.postFanout(&wg, b)
+	}
+
+	m.logPost(b)
+
+	var trace ttfbTrace
+	start := time.Now()
+	resp, err := m.c.post(trace.context(context.Background()), b)
+	elapsed := time.Since(start)
 	if err != nil {
-		m.statReqErr(&b.MiniStats)
-		return
+		m.statReqErr(&b.MiniStats, err)
+		m.logPostFailed(b, err)
+		m.adapt(false)
+		m.recover(b, false)
+		m.maybeReconnect()
+		return err
 	}
 
 	defer resp.Body.Close()
 
+	if ttfb, ok := trace.ttfb(); ok {
+		m.statTTFB(ttfb)
+	}
+
+	if m.maxConsecutiveErrors > 0 {
+		atomic.StoreInt32(&m.consecutiveErrors, 0)
+	}
+
+	if resp.ProtoMajor == 2 {
+		m.statHTTP2()
+	}
+
 	// Check HTTP return code and accrue statistics accordingly.
 	if resp.StatusCode != http.StatusNoContent {
-		m.statReqRej(&b.MiniStats)
+		m.statReqRej(&b.MiniStats, resp.StatusCode)
+		m.logRejected(b, resp.StatusCode)
+		m.adapt(false)
+		m.recover(b, true)
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	m.statReqSuccess(&b.MiniStats, b.retried(), elapsed)
+	m.adapt(true)
+	return nil
+}
+
+// Buffer again the messages of a failed post that have not already
+// been recovered before, if so configured, and write the rest to the
+// fallback writer.  Whether the post was rejected, or failed outright,
+// says where the messages over MaxRecoveryMessages were counted,
+// before they are counted as dropped instead.
+func (m *Client) recover(b *Bundle, rejected bool) {
+	if !m.recoverOnError {
+		m.writeFallback(b, nil)
+		return
+	}
+
+	var lost []bool
+	var recovered, over uint64
+	moved := m.c.rebuffer(b, func(attempts int) bool {
+		again := attempts == 0
+		if again && m.maxRecoveryMessages > 0 &&
+			recovered >= uint64(m.maxRecoveryMessages) {
+			over += 1
+			again = false
+		}
+
+		if again {
+			recovered += 1
+		}
+
+		if m.fallback != nil {
+			lost = append(lost, !again)
+		}
+
+		return again
+	})
+
+	m.statLock.Lock()
+	m.Recovered += moved.NumberFramed
+	m.Dropped += over
+	if rejected {
+		m.Rejected -= over
 	} else {
-		m.statReqSuccess(&b.MiniStats)
+		m.Cancelled -= over
+	}
+	m.statLock.Unlock()
+
+	m.writeFallback(b, lost)
+}
+
+// Count a failed post, and once maxConsecutiveErrors have failed in
+// a row, drop idle connections and pause for reconnectDelay.
+func (m *Client) maybeReconnect() {
+	if m.maxConsecutiveErrors <= 0 {
+		return
+	}
+
+	n := atomic.AddInt32(&m.consecutiveErrors, 1)
+	if n < m.maxConsecutiveErrors ||
+		!atomic.CompareAndSwapInt32(&m.consecutiveErrors, n, 0) {
+		return
+	}
+
+	m.logReconnect(n, m.reconnectDelay)
+	m.c.CloseIdleConnections()
+
+	if m.reconnectDelay > 0 {
+		t := time.NewTimer(m.reconnectDelay)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-m.finalize:
+		}
+	}
+}
+
+// Remove messages older than maxMessageAge from a bundle.
+func (m *Client) dropStale(b *Bundle) {
+	cutoff := time.Now().Add(-m.maxMessageAge)
+
+	dropped := b.filter(func(msg []byte) bool {
+		ts, err := syslogTimestamp(msg)
+		return err != nil || !ts.Before(cutoff)
+	})
+
+	if dropped > 0 {
+		m.statLock.Lock()
+		m.AgeDropped += dropped
+		m.statLock.Unlock()
 	}
 }
 
 func (m *Client) statReqTotalUnsync(s *MiniStats) {
 	m.Total += s.NumberFramed
-	m.TotalRequests += 1
+	m.TotalPosts += 1
+	m.TotalRequests = m.TotalPosts
 }
 
-func (m *Client) statReqSuccess(s *MiniStats) {
+func (m *Client) statReqSuccess(s *MiniStats, retried uint64,
+	elapsed time.Duration) {
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
 	m.statReqTotalUnsync(s)
 
 	m.Successful += s.NumberFramed
+	m.SuccessAfterRetry += retried
 	m.SuccessRequests += 1
+	m.CumulativeSuccessBytes += uint64(s.Buffered)
+
+	// Update the mean incrementally, rather than keeping a sum
+	// of latencies that could grow without bound.
+	ms := float64(elapsed) / float64(time.Millisecond)
+	m.MeanSuccessLatencyMs +=
+		(ms - m.MeanSuccessLatencyMs) / float64(m.SuccessRequests)
+}
+
+func (m *Client) statTTFB(ttfb time.Duration) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.ttfbSamples += 1
+	ms := float64(ttfb) / float64(time.Millisecond)
+	m.AvgTTFBMillis += (ms - m.AvgTTFBMillis) / float64(m.ttfbSamples)
 }
 
-func (m *Client) statReqErr(s *MiniStats) {
+func (m *Client) statReqErr(s *MiniStats, err error) {
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
 	m.statReqTotalUnsync(s)
 
 	m.Cancelled += s.NumberFramed
 	m.CancelRequests += 1
+
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &ne) && ne.Timeout()) {
+		m.TimeoutErrors += 1
+	} else {
+		m.NetworkErrors += 1
+	}
 }
 
-func (m *Client) statReqRej(s *MiniStats) {
+func (m *Client) statReqRej(s *MiniStats, statusCode int) {
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
 	m.statReqTotalUnsync(s)
 
 	m.Rejected += s.NumberFramed
 	m.RejectRequests += 1
+
+	switch {
+	case statusCode == http.StatusUnauthorized ||
+		statusCode == http.StatusForbidden:
+		m.AuthErrors += 1
+	case statusCode >= 400 && statusCode < 500:
+		m.ClientErrors += 1
+	case statusCode >= 500 && statusCode < 600:
+		m.ServerErrors += 1
+	}
 }
 
 func (m *Client) statReqDrop(s *MiniStats) {
@@ -314,4 +1793,66 @@ func (m *Client) statReqDrop(s *MiniStats) {
 
 	m.Dropped += s.NumberFramed
 	m.DroppedRequests += 1
+	m.CumulativeDropBytes += uint64(s.Buffered)
+}
+
+func (m *Client) statTrimmed(s *MiniStats) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.Total += s.NumberFramed
+	m.Dropped += s.NumberFramed
+	m.CumulativeDropBytes += uint64(s.Buffered)
+}
+
+func (m *Client) statHTTP2() {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.HTTP2Requests += 1
+}
+
+func (m *Client) statFanoutFailed() {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.FanoutFailedRequests += 1
+}
+
+func (m *Client) statFiltered(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.Filtered += n
+}
+
+func (m *Client) statRateLimited(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	// Counted in Total too, as every other message that is
+	// dropped is.
+	m.Total += n
+	m.Dropped += n
+}
+
+func (m *Client) statEscaped(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.EscapedMessages += n
+}
+
+func (m *Client) statFallbackSkipped(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.FallbackSkipped += n
+}
+
+func (m *Client) statDeduped(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.Deduped += n
 }
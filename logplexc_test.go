@@ -0,0 +1,3430 @@
+package logplexc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A fake logplex that records what is posted to it.
+type testServer struct {
+	*httptest.Server
+
+	// Called before each response, if set before use.
+	hook func(r *http.Request, body []byte)
+
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+	messages uint64
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := newUnstartedTestServer(t)
+	ts.Start()
+	return ts
+}
+
+// For tests that need to set up the server, e.g. to use TLS.
+func newUnstartedTestServer(t *testing.T) *testServer {
+	ts := &testServer{status: http.StatusNoContent}
+	ts.Server = httptest.NewUnstartedServer(
+		http.HandlerFunc(ts.serveHTTP))
+	return ts
+}
+
+func (ts *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n, _ := strconv.ParseUint(r.Header.Get("Logplex-Msg-Count"), 10, 64)
+
+	if ts.hook != nil {
+		ts.hook(r, body)
+	}
+
+	ts.mu.Lock()
+	ts.requests = append(ts.requests, r)
+	ts.bodies = append(ts.bodies, body)
+	ts.messages += n
+	status := ts.status
+	ts.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (ts *testServer) setStatus(status int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.status = status
+}
+
+func (ts *testServer) messageCount() uint64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.messages
+}
+
+func (ts *testServer) requestCount() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.requests)
+}
+
+func (ts *testServer) body(i int) []byte {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.bodies[i]
+}
+
+func (ts *testServer) logplexUrl(t *testing.T) url.URL {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Could not parse test server url: %v", err)
+	}
+
+	return *u
+}
+
+// A configuration that only posts when asked to.
+func (ts *testServer) config(t *testing.T) Config {
+	return Config{
+		Logplex:            ts.logplexUrl(t),
+		HttpClient:         *http.DefaultClient,
+		RequestSizeTrigger: 100 * KB,
+		Concurrency:        1,
+		TimeTrigger:        TimeTriggerNever,
+		Token:              testToken,
+	}
+}
+
+func newTestClient(t *testing.T, cfg *Config) *Client {
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Could not create Client: %v", err)
+	}
+
+	return c
+}
+
+// Poll for a condition brought about by other goroutines.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInputChan(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	const n = 100
+	in := c.InputChan(10)
+	for i := 0; i < n; i += 1 {
+		in <- LogMessage{
+			When:   time.Now(),
+			Host:   "host",
+			ProcId: "web.1",
+			Log:    []byte("message " + strconv.Itoa(i)),
+		}
+	}
+	close(in)
+
+	waitFor(t, "messages to be delivered", func() bool {
+		return c.Statistics().Successful == n
+	})
+
+	if m := ts.messageCount(); m != n {
+		t.Fatalf("Expected %d messages to be received, got %d",
+			n, m)
+	}
+}
+
+func TestInputChanFlushesWhenBusy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	// Hold up the first post only.
+	var posts int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			close(entered)
+			<-release
+		}
+	}
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+
+	// Keep the only worker busy.
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("busy"))
+	c.maybeWork()
+	<-entered
+
+	const n = 10
+	in := c.InputChan(n)
+	for i := 0; i < n; i += 1 {
+		in <- LogMessage{
+			When:   time.Now(),
+			Host:   "host",
+			ProcId: "web.1",
+			Log:    []byte("message " + strconv.Itoa(i)),
+		}
+	}
+	close(in)
+
+	waitFor(t, "messages to be delivered", func() bool {
+		return c.Statistics().Successful == n
+	})
+	unblock()
+
+	waitFor(t, "the busy worker to finish", func() bool {
+		return c.Statistics().Successful == n+1
+	})
+
+	if s := c.Statistics(); s.Dropped != 0 || ts.messageCount() != n+1 {
+		t.Fatalf("Expected all %d messages delivered, got %+v",
+			n+1, s)
+	}
+}
+
+func TestInputChanAfterClose(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	in := c.InputChan(0)
+	c.Close()
+
+	// Sends to a closed Client must not block.
+	for i := 0; i < 10; i += 1 {
+		in <- LogMessage{When: time.Now(), Log: []byte("dropped")}
+	}
+	close(in)
+
+	if n := ts.requestCount(); n != 0 {
+		t.Fatalf("Expected no requests, got %d", n)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Unexpected ping error: %v", err)
+	}
+
+	if !bytes.Contains(ts.body(0), []byte(" "+PingProcId+" ")) {
+		t.Fatalf("Ping message not identifiable: %q", ts.body(0))
+	}
+
+	ts.setStatus(http.StatusBadRequest)
+	err := c.Ping(context.Background())
+	pe, ok := err.(*PingError)
+	if !ok {
+		t.Fatalf("Expected a *PingError, got %v", err)
+	}
+
+	if pe.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected status %d", pe.StatusCode)
+	}
+
+	if s := c.Statistics(); s != (Stats{}) {
+		t.Fatalf("Ping affected statistics: %+v", s)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MinLevel = LevelWarn
+	cfg.TimeTrigger = TimeTriggerImmediate
+	c := newTestClient(t, &cfg)
+
+	levels := []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError}
+	for _, level := range levels {
+		err := c.BufferMessage(level, time.Now(), "host", "web.1",
+			[]byte("level "+strconv.Itoa(int(level))))
+		if err != nil {
+			t.Fatalf("Could not buffer message: %v", err)
+		}
+
+		// Let each post finish, so none are dropped.
+		waitFor(t, "the post to finish", func() bool {
+			return len(c.bucket) == cfg.Concurrency
+		})
+	}
+	c.Close()
+
+	if s := c.Statistics(); s.Filtered != 2 || s.Successful != 2 {
+		t.Fatalf("Expected 2 filtered and 2 successful, got %+v", s)
+	}
+
+	for i := 0; i < ts.requestCount(); i += 1 {
+		body := ts.body(i)
+		if bytes.Contains(body, []byte("level 0")) ||
+			bytes.Contains(body, []byte("level 1")) {
+			t.Fatalf("Filtered message was sent: %q", body)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	if n := ts.messageCount(); n != 3 {
+		t.Fatalf("Expected 3 messages to be received, got %d", n)
+	}
+
+	s := c.Statistics()
+	if s.Successful != 3 || s.SuccessRequests != 1 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	c.Flush()
+
+	lookup := func(name string) string {
+		var found string
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key == name {
+				found = kv.Value.String()
+			}
+		})
+		return found
+	}
+
+	c.RegisterExpvar("logplexc-test")
+
+	// Registering again must not panic.
+	c.RegisterExpvar("logplexc-test")
+
+	var s map[string]interface{}
+	err := json.Unmarshal([]byte(lookup("logplexc-test")), &s)
+	if err != nil {
+		t.Fatalf("Could not decode expvar: %v", err)
+	}
+
+	for _, field := range []string{
+		"Total", "Successful", "TotalPosts", "TotalRequests",
+	} {
+		if v, ok := s[field]; !ok || v != float64(1) {
+			t.Errorf("Expected %s of 1, got %v", field, v)
+		}
+	}
+
+	c.UnregisterExpvar("logplexc-test")
+	if v := lookup("logplexc-test"); v != "null" {
+		t.Fatalf("Expected null after unregistering, got %s", v)
+	}
+}
+
+func TestConcurrencyPercentile(t *testing.T) {
+	var cs concurrencySamples
+	if p := cs.percentile(0.95); p != 0 {
+		t.Fatalf("Expected 0 without samples, got %d", p)
+	}
+
+	// 100 down to 1: the 95th percentile is 95.
+	for i := int32(100); i > 0; i -= 1 {
+		cs.add(i)
+	}
+	if p := cs.percentile(0.95); p != 95 {
+		t.Fatalf("Expected 95, got %d", p)
+	}
+
+	// Overwrite the whole window with a level of 3.
+	for i := 0; i < concurrencySampleCount; i += 1 {
+		cs.add(3)
+	}
+	if p := cs.percentile(0.95); p != 3 {
+		t.Fatalf("Expected old samples to slide out, got %d", p)
+	}
+
+	// Statistics takes the percentile with statLock held.
+	allocs := testing.AllocsPerRun(100, func() { cs.percentile(0.95) })
+	if allocs != 0 {
+		t.Fatalf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestTraceHTTP(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var trace bytes.Buffer
+	cfg := ts.config(t)
+	cfg.TraceHTTP = true
+	cfg.TraceWriter = &trace
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	line := trace.String()
+	for _, want := range []string{
+		"POST ", ts.Listener.Addr().String(), `Logplex-Msg-Count="1"`,
+		"-> 204 No Content",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %q in trace %q", want, line)
+		}
+	}
+
+	if strings.Contains(line, testToken) {
+		t.Errorf("Token leaked into trace %q", line)
+	}
+}
+
+func TestBulkBufferMessages(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MinLevel = LevelInfo
+	c := newTestClient(t, &cfg)
+
+	var msgs []LogEntry
+	for i := 0; i < 10; i += 1 {
+		level := LevelInfo
+		if i%2 == 0 {
+			level = LevelDebug
+		}
+
+		msgs = append(msgs, LogEntry{
+			Level:  level,
+			When:   time.Now(),
+			Host:   "host",
+			ProcId: "web.1",
+			Log:    []byte("message " + strconv.Itoa(i)),
+		})
+	}
+
+	n, err := c.BulkBufferMessages(msgs)
+	if err != nil || n != 5 {
+		t.Fatalf("Expected 5 buffered messages, got %d, %v", n, err)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	if s := c.Statistics(); s.Successful != 5 || s.Filtered != 5 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+
+	c.Close()
+	if _, err := c.BulkBufferMessages(msgs); err == nil {
+		t.Fatal("Expected an error buffering to a closed client")
+	}
+}
+
+func TestMaxMessageAge(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MaxMessageAge = time.Minute
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	old := time.Now().Add(-time.Hour)
+	c.BufferMessage(LevelInfo, old, "host", "web.1", []byte("stale"))
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("fresh"))
+	c.BufferMessage(LevelInfo, old, "host", "web.1", []byte("stale"))
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	if n := ts.messageCount(); n != 1 {
+		t.Fatalf("Expected one message to be received, got %d", n)
+	}
+
+	body := ts.body(0)
+	if bytes.Contains(body, []byte("stale")) ||
+		!bytes.Contains(body, []byte("fresh")) {
+		t.Fatalf("Unexpected body %q", body)
+	}
+
+	// A bundle of nothing but stale messages is not posted at all.
+	c.BufferMessage(LevelInfo, old, "host", "web.1", []byte("stale"))
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	if n := ts.requestCount(); n != 1 {
+		t.Fatalf("Expected no further requests, got %d", n-1)
+	}
+
+	if s := c.Statistics(); s.AgeDropped != 3 || s.Successful != 1 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+}
+
+func TestCumulativeBytes(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.Concurrency = 0
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	// With no concurrency tokens, everything handed to a worker
+	// is dropped.
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("dropped"))
+	dropped := c.c.Statistics().Buffered
+	c.maybeWork()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("sent"))
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	s := c.Statistics()
+	if s.CumulativeSuccessBytes != uint64(len(ts.body(0))) {
+		t.Fatalf("Expected %d success bytes, got %d",
+			len(ts.body(0)), s.CumulativeSuccessBytes)
+	}
+
+	if s.CumulativeDropBytes != uint64(dropped) {
+		t.Fatalf("Expected %d drop bytes, got %d",
+			dropped, s.CumulativeDropBytes)
+	}
+}
+
+func TestUseHTTP2(t *testing.T) {
+	ts := newUnstartedTestServer(t)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, useHTTP2 := range []bool{false, true} {
+		// A transport with its own TLS configuration, which
+		// net/http does not upgrade to HTTP/2 unless forced.
+		tr := ts.Client().Transport.(*http.Transport)
+		cfg := ts.config(t)
+		cfg.HttpClient.Transport = &http.Transport{
+			TLSClientConfig: tr.TLSClientConfig,
+		}
+		cfg.UseHTTP2 = useHTTP2
+		c := newTestClient(t, &cfg)
+
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err != nil {
+			t.Fatalf("Could not flush: %v", err)
+		}
+		c.Close()
+
+		want := uint64(0)
+		if useHTTP2 {
+			want = 1
+		}
+
+		if s := c.Statistics(); s.HTTP2Requests != want {
+			t.Fatalf("UseHTTP2 %v: expected %d HTTP/2 requests, "+
+				"got %d", useHTTP2, want, s.HTTP2Requests)
+		}
+	}
+}
+
+func TestMiniClientPool(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var pool sync.Pool
+	cfg := ts.config(t)
+	cfg.MiniClientPool = &pool
+
+	c := newTestClient(t, &cfg)
+	mc := c.c
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("unsent"))
+	c.Close()
+	first := c
+	final := first.Statistics()
+
+	// sync.Pool may drop entries whenever it likes, so have it
+	// fall back to the MiniClient under test.
+	pool.New = func() interface{} { return mc }
+
+	c = newTestClient(t, &cfg)
+	if c.c != mc {
+		t.Fatal("Expected the pooled MiniClient to be re-used")
+	}
+
+	if s := c.c.Statistics(); s.NumberFramed != 0 {
+		t.Fatalf("Re-used MiniClient has leftovers: %+v", s)
+	}
+
+	// The closed Client no longer looks at the MiniClient it
+	// gave back.
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("someone else's"))
+	if c.Statistics().CurrentBundleID == "" {
+		t.Fatal("Expected the new Client to have a bundle")
+	}
+
+	if s := first.Statistics(); s != final || s.CurrentBundleID != "" {
+		t.Fatalf("Closed Client's statistics changed from %+v to %+v",
+			final, s)
+	}
+	c.Close()
+
+	// An entry for a different token is not fit for use, but is
+	// kept for a Client it suits.  sync.Pool may drop what is Put
+	// -- under the race detector, it does so at random -- so give
+	// it a few tries.
+	other := cfg
+	other.Token = "t.ffffffff-ffff-ffff-ffff-ffffffffffff"
+	pool.New = nil
+	drain := func() (kept bool) {
+		for {
+			pooled, ok := pool.Get().(*MiniClient)
+			if !ok {
+				return kept
+			}
+
+			kept = kept || pooled == mc
+		}
+	}
+
+	drain()
+	kept := false
+	for i := 0; i < 20 && !kept; i += 1 {
+		pool.Put(mc)
+		c = newTestClient(t, &other)
+		if c.c == mc {
+			t.Fatal("MiniClient re-used for a different token")
+		}
+		c.Close()
+
+		kept = drain()
+	}
+
+	if !kept {
+		t.Fatal("Expected the MiniClient to be put back")
+	}
+
+	// Neither is something that is not a MiniClient at all.
+	pool = sync.Pool{New: func() interface{} { return "bogus" }}
+	c = newTestClient(t, &cfg)
+	c.Close()
+}
+
+func TestMaxIdleTime(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	closed := make(chan struct{})
+	cfg := ts.config(t)
+	cfg.MaxIdleTime = 50 * time.Millisecond
+	cfg.OnClose = func() { close(closed) }
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	// Keep the Client busy for a few multiples of MaxIdleTime.
+	for i := 0; i < 10; i += 1 {
+		err := c.BufferMessage(LevelInfo, time.Now(), "host",
+			"web.1", []byte("busy"))
+		if err != nil {
+			t.Fatalf("Client closed while busy: %v", err)
+		}
+
+		time.Sleep(cfg.MaxIdleTime / 5)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the idle Client to close")
+	}
+
+	// Closing is graceful, so nothing was lost.
+	if n := ts.messageCount(); n != 10 {
+		t.Fatalf("Expected 10 messages to be received, got %d", n)
+	}
+
+	err := c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("too late"))
+	if err != ErrClientClosed {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestRecentRates(t *testing.T) {
+	// The window, on a clock of its own: 50 messages in 5
+	// bundles a second, for three seconds, and half a second
+	// into the fourth with nothing more.
+	start := time.Now()
+	w := rateWindow{curStart: start}
+	for sec := 1; sec <= 3; sec += 1 {
+		w.countMessages(50)
+		for i := 0; i < 5; i += 1 {
+			w.countBundle()
+		}
+
+		w.tick(start.Add(time.Duration(sec) * time.Second))
+	}
+
+	msgs, bdls := w.rates(start.Add(3500 * time.Millisecond))
+	if msgs != 150/3.5 || bdls != 15/3.5 {
+		t.Fatalf("Expected %v messages and %v bundles per second, "+
+			"got %v and %v", 150/3.5, 15/3.5, msgs, bdls)
+	}
+
+	// Only the oldest minute is counted.
+	for sec := 4; sec <= rateWindowSeconds+3; sec += 1 {
+		w.countMessages(10)
+		w.tick(start.Add(time.Duration(sec) * time.Second))
+	}
+
+	now := start.Add(time.Duration(rateWindowSeconds+3) * time.Second)
+	if msgs, bdls := w.rates(now); msgs != 10 || bdls != 0 {
+		t.Fatalf("Expected 10 messages and no bundles per second, "+
+			"got %v and %v", msgs, bdls)
+	}
+
+	// And through a Client, on the wall clock, whose rates can
+	// only be relied on to have been counted.
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 50; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+
+		if i%10 == 9 {
+			c.Flush()
+		}
+	}
+
+	s := c.Statistics()
+	if s.RecentBundlesPerSecond <= 0 ||
+		s.RecentMessagesPerSecond <= s.RecentBundlesPerSecond {
+		t.Fatalf("Expected more messages than bundles a second, "+
+			"got %v and %v", s.RecentMessagesPerSecond,
+			s.RecentBundlesPerSecond)
+	}
+}
+
+func TestOrderByProcId(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	// Record the sequence numbers received for each procId, after
+	// a random delay that would reorder concurrent posts.
+	var mu sync.Mutex
+	received := make(map[string][]int)
+	ts.hook = func(r *http.Request, body []byte) {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for rest := body; len(rest) > 0; {
+			_, msg, next, err := nextFrame(rest)
+			if err != nil {
+				t.Errorf("Could not parse %q: %v", rest, err)
+				return
+			}
+
+			fields := strings.Fields(string(msg))
+			seq, _ := strconv.Atoi(fields[len(fields)-1])
+			procId := syslogProcId(msg)
+			received[procId] = append(received[procId], seq)
+			rest = next
+		}
+	}
+
+	cfg := ts.config(t)
+	cfg.Concurrency = 4
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.OrderByProcId = true
+	c := newTestClient(t, &cfg)
+
+	procIds := []string{"web.1", "web.2", "worker.1"}
+	for i := 0; i < 300; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host",
+			procIds[i%len(procIds)], []byte(strconv.Itoa(i)))
+
+		if i%20 == 0 {
+			// Give the workers a chance to catch up, so
+			// that not everything is dropped.
+			time.Sleep(time.Millisecond)
+		}
+	}
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for procId, seqs := range received {
+		for i := 1; i < len(seqs); i += 1 {
+			if seqs[i] <= seqs[i-1] {
+				t.Fatalf("%s received out of order: %v",
+					procId, seqs)
+			}
+		}
+	}
+
+	// Ordering is only put to the test by many posts for each
+	// procId.
+	if s := c.Statistics(); s.SuccessRequests < 10 {
+		t.Fatalf("Expected at least 10 posts, got %+v", s)
+	}
+
+	for _, procId := range procIds {
+		if n := len(received[procId]); n < 5 {
+			t.Fatalf("Expected at least 5 messages for %s, got %d",
+				procId, n)
+		}
+	}
+
+	if len(c.procIdTails) != 0 {
+		t.Fatalf("Ordering state leaked: %v", c.procIdTails)
+	}
+}
+
+func TestNewClientFromHerokuEnv(t *testing.T) {
+	ts := newTestServer(t)
+	u := ts.logplexUrl(t)
+	u.User = url.UserPassword("token", testToken)
+
+	t.Setenv("LOGPLEX_URL", u.String())
+	t.Setenv("LOGPLEX_TOKEN", "")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Token != testToken || cfg.Concurrency != 4 ||
+		cfg.Period != 500*time.Millisecond ||
+		cfg.RequestSizeTrigger != 100*KB {
+		t.Fatalf("Unexpected config: %+v", cfg)
+	}
+
+	c, err := NewClientFromHerokuEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "app", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ts.messageCount(); n != 1 {
+		t.Fatalf("Expected 1 message, got %d", n)
+	}
+
+	t.Setenv("LOGPLEX_URL", "")
+	if _, err := NewClientFromHerokuEnv(); err == nil {
+		t.Fatal("Expected an error without LOGPLEX_URL")
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var headers []http.Header
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = append(headers, r.Header)
+	}
+
+	cfg := ts.config(t)
+	cfg.RequestMetadata = map[string]string{
+		"X-Route":      "logs-eu",
+		"Content-Type": "text/plain",
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 2; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(headers))
+	}
+
+	for _, h := range headers {
+		if got := h.Get("X-Route"); got != "logs-eu" {
+			t.Fatalf("Expected X-Route logs-eu, got %q", got)
+		}
+
+		if got := h["Content-Type"]; len(got) != 1 ||
+			got[0] != "application/logplex-1" {
+			t.Fatalf("Content-Type was overridden: %q", got)
+		}
+	}
+}
+
+// A transport that fails as many requests as failures before
+// succeeding, and records calls to CloseIdleConnections.
+type flakyTripper struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	closes   []int
+}
+
+func (ft *flakyTripper) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.calls += 1
+	if ft.calls <= ft.failures {
+		return nil, io.EOF
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusNoContent,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func (ft *flakyTripper) CloseIdleConnections() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	// Record after which call the connections were closed.
+	ft.closes = append(ft.closes, ft.calls)
+}
+
+func TestMaxConsecutiveErrors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ft := &flakyTripper{failures: 5}
+
+	cfg := ts.config(t)
+	cfg.HttpClient.Transport = ft
+	cfg.MaxConsecutiveErrors = 2
+	cfg.ReconnectDelay = time.Millisecond
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 8; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		err := c.Flush()
+
+		if i < ft.failures && err == nil {
+			t.Fatalf("Expected post %d to fail", i)
+		} else if i >= ft.failures && err != nil {
+			t.Fatalf("Expected post %d to succeed: %v", i, err)
+		}
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if len(ft.closes) != 2 || ft.closes[0] != 2 || ft.closes[1] != 4 {
+		t.Fatalf("Expected connections closed after posts 2 and 4, "+
+			"got %v", ft.closes)
+	}
+
+	if n := atomic.LoadInt32(&c.consecutiveErrors); n != 0 {
+		t.Fatalf("Expected the error count reset, got %d", n)
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var routes []string
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		routes = append(routes, r.Header.Get("X-Route"))
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := ts.config(t)
+	cfg.RequestMetadata = map[string]string{"X-Route": "metadata"}
+	cfg.CustomHeaders = map[string]string{
+		"X-Route":       "custom",
+		"authorization": "Bearer nope",
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	if !strings.Contains(logged.String(), `"authorization"`) {
+		t.Fatalf("Expected a warning about authorization, got %q",
+			logged.String())
+	}
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(routes) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(routes))
+	}
+
+	for _, r := range routes {
+		if r != "custom" {
+			t.Fatalf("Expected X-Route custom, got %q", r)
+		}
+	}
+}
+
+func TestMeanSuccessLatency(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	delay := 10 * time.Millisecond
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		d := delay
+		mu.Unlock()
+		time.Sleep(d)
+	}
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	post := func() {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post()
+	mu.Lock()
+	delay = 30 * time.Millisecond
+	mu.Unlock()
+	post()
+
+	// Failures are not counted.
+	ts.setStatus(http.StatusInternalServerError)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	c.Flush()
+
+	s := c.Statistics()
+	if s.SuccessRequests != 2 {
+		t.Fatalf("Expected 2 successful requests, got %d",
+			s.SuccessRequests)
+	}
+
+	if s.MeanSuccessLatencyMs < 20 || s.MeanSuccessLatencyMs > 1000 {
+		t.Fatalf("Expected a mean latency of about 20ms, got %v",
+			s.MeanSuccessLatencyMs)
+	}
+}
+
+func TestPinnedCertSHA256(t *testing.T) {
+	ts := newUnstartedTestServer(t)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	digest := sha256.Sum256(ts.Certificate().Raw)
+
+	for _, tc := range []struct {
+		pin string
+		ok  bool
+	}{
+		{hex.EncodeToString(digest[:]), true},
+		{strings.Repeat("00", sha256.Size), false},
+	} {
+		cfg := ts.config(t)
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+		cfg.PinnedCertSHA256 = tc.pin
+		c := newTestClient(t, &cfg)
+
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		err := c.Flush()
+		c.Close()
+
+		if tc.ok && err != nil {
+			t.Fatalf("Expected the correct pin to succeed: %v", err)
+		} else if !tc.ok && err == nil {
+			t.Fatal("Expected a wrong pin to fail")
+		}
+	}
+
+	cfg := ts.config(t)
+	cfg.PinnedCertSHA256 = "not-hex"
+	if _, err := NewClient(&cfg); err == nil {
+		t.Fatal("Expected a malformed pin to be rejected")
+	}
+}
+
+func TestPinnedCertSHA256Resumed(t *testing.T) {
+	ts := newUnstartedTestServer(t)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	digest := sha256.Sum256(ts.Certificate().Raw)
+	cache := tls.NewLRUClientSessionCache(0)
+
+	var resumed int32
+	post := func(pin string) error {
+		cfg := ts.config(t)
+		cfg.TLSConfig = &tls.Config{
+			RootCAs:            roots,
+			ClientSessionCache: cache,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if cs.DidResume {
+					atomic.StoreInt32(&resumed, 1)
+				}
+				return nil
+			},
+		}
+		cfg.PinnedCertSHA256 = pin
+		c := newTestClient(t, &cfg)
+		defer c.Close()
+
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		return c.Flush()
+	}
+
+	// The first post leaves a session in the cache, which the
+	// second resumes.
+	pin := hex.EncodeToString(digest[:])
+	for i := 0; i < 2; i += 1 {
+		if err := post(pin); err != nil {
+			t.Fatalf("Expected the correct pin to succeed: %v", err)
+		}
+	}
+
+	if atomic.LoadInt32(&resumed) == 0 {
+		t.Fatal("Expected the TLS session to be resumed")
+	}
+
+	if err := post(strings.Repeat("00", sha256.Size)); err == nil {
+		t.Fatal("Expected a wrong pin to fail on a resumed session")
+	}
+}
+
+func TestFanoutLogplex(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	other := newTestServer(t)
+	defer other.Close()
+
+	rejecting := newTestServer(t)
+	defer rejecting.Close()
+	rejecting.setStatus(http.StatusServiceUnavailable)
+
+	cfg := ts.config(t)
+	cfg.FanoutLogplex = []url.URL{
+		other.logplexUrl(t), rejecting.logplexUrl(t),
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("A failing fanout endpoint failed the flush: %v", err)
+	}
+
+	for _, s := range []*testServer{ts, other, rejecting} {
+		if n := s.messageCount(); n != 3 {
+			t.Fatalf("Expected 3 messages at %s, got %d", s.URL, n)
+		}
+	}
+
+	s := c.Statistics()
+	if s.Successful != 3 || s.FanoutFailedRequests != 1 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+}
+
+func TestRecoverOnError(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.setStatus(http.StatusServiceUnavailable)
+
+	cfg := ts.config(t)
+	cfg.RecoverOnError = true
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("recover me"))
+	}
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the first flush to fail")
+	}
+
+	if s := c.Statistics(); s.Recovered != 3 {
+		t.Fatalf("Expected 3 recovered messages, got %+v", s)
+	}
+
+	// Failing a second time loses the messages for good.
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the second flush to fail")
+	}
+
+	if s := c.Statistics(); s.Recovered != 3 {
+		t.Fatalf("Messages were recovered twice: %+v", s)
+	}
+
+	ts.setStatus(http.StatusNoContent)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("fresh"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ts.messageCount(); n != 7 {
+		t.Fatalf("Expected 3 + 3 + 1 messages posted, got %d", n)
+	}
+
+	if s := c.Statistics(); s.Successful != 1 ||
+		s.SuccessAfterRetry != 0 {
+		t.Fatalf("Expected 1 successful message, got %+v", s)
+	}
+}
+
+func TestSuccessAfterRetry(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.setStatus(http.StatusServiceUnavailable)
+
+	cfg := ts.config(t)
+	cfg.RecoverOnError = true
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 2; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("retry me"))
+	}
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the first flush to fail")
+	}
+
+	ts.setStatus(http.StatusNoContent)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("first try"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Statistics(); s.Successful != 3 ||
+		s.SuccessAfterRetry != 2 {
+		t.Fatalf("Expected 2 of 3 successful messages retried, "+
+			"got %+v", s)
+	}
+}
+
+func TestMaxRecoveryMessages(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.setStatus(http.StatusServiceUnavailable)
+
+	cfg := ts.config(t)
+	cfg.RecoverOnError = true
+	cfg.MaxRecoveryMessages = 2
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 5; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(fmt.Sprintf("message %d", i)))
+	}
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	// Each message is counted once: the dropped ones no longer
+	// as rejected.
+	if s := c.Statistics(); s.Recovered != 2 || s.Dropped != 3 ||
+		s.Rejected != 2 || s.Total != 5 {
+		t.Fatalf("Expected 2 recovered and rejected, and 3 dropped, "+
+			"got %+v", s)
+	}
+
+	ts.setStatus(http.StatusNoContent)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := ts.body(1)
+	if !bytes.Contains(body, []byte("message 0")) ||
+		!bytes.Contains(body, []byte("message 1")) ||
+		bytes.Contains(body, []byte("message 2")) {
+		t.Fatalf("Expected the earliest messages recovered, got %q",
+			body)
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var delay time.Duration
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		d := delay
+		mu.Unlock()
+		time.Sleep(d)
+	}
+
+	cfg := ts.config(t)
+	cfg.HttpClient.Timeout = 50 * time.Millisecond
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	post := func() {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err == nil {
+			t.Fatal("Expected the post to fail")
+		}
+	}
+
+	for _, status := range []int{401, 403, 404, 413, 500, 503, 504} {
+		ts.setStatus(status)
+		post()
+	}
+
+	mu.Lock()
+	delay = 200 * time.Millisecond
+	mu.Unlock()
+	post()
+
+	// A transport failure that is not a timeout.
+	c.c.HttpClient.Transport = &flakyTripper{failures: 1}
+	post()
+
+	s := c.Statistics()
+	if s.AuthErrors != 2 || s.ClientErrors != 2 ||
+		s.ServerErrors != 3 || s.TimeoutErrors != 1 ||
+		s.NetworkErrors != 1 {
+		t.Fatalf("Unexpected error categories: %+v", s)
+	}
+
+	if s.RejectRequests != 7 || s.CancelRequests != 2 {
+		t.Fatalf("Aggregates do not add up: %+v", s)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerPeriodic
+	cfg.Period = 50 * time.Millisecond
+	cfg.GracePeriod = 5 * time.Second
+	c := newTestClient(t, &cfg)
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+
+	start := time.Now()
+	c.Close()
+
+	if n := ts.messageCount(); n != 3 {
+		t.Fatalf("Expected 3 messages posted within the grace "+
+			"period, got %d", n)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close waited out the grace period: %v", elapsed)
+	}
+}
+
+func TestDedupeWindow(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.DedupeWindow = 200 * time.Millisecond
+	cfg.DedupeMaxEntries = 2
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	buffer := func(log string) {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	for i := 0; i < 100; i += 1 {
+		buffer("GET /health 200")
+	}
+
+	if s := c.Statistics(); s.Deduped != 99 {
+		t.Fatalf("Expected 99 deduplicated messages, got %+v", s)
+	}
+
+	// The health check is forgotten once two other messages
+	// have been seen since.
+	buffer("a")
+	buffer("b")
+	buffer("GET /health 200")
+
+	time.Sleep(cfg.DedupeWindow)
+	buffer("GET /health 200")
+
+	n, _ := c.BulkBufferMessages([]LogEntry{
+		{Level: LevelInfo, When: time.Now(), Host: "host",
+			ProcId: "web.1", Log: []byte("GET /health 200")},
+		{Level: LevelInfo, When: time.Now(), Host: "host",
+			ProcId: "web.2", Log: []byte("GET /health 200")},
+	})
+	if n != 1 {
+		t.Fatalf("Expected 1 of the bulk messages buffered, got %d", n)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ts.messageCount(); n != 6 {
+		t.Fatalf("Expected 6 messages posted, got %d", n)
+	}
+
+	if s := c.Statistics(); s.Deduped != 100 {
+		t.Fatalf("Expected 100 deduplicated messages, got %+v", s)
+	}
+}
+
+func TestBundleQueueDepth(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		<-release
+	}
+
+	cfg := ts.config(t)
+	cfg.Concurrency = 3
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.OrderByProcId = true
+	c := newTestClient(t, &cfg)
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+
+	// The first bundle is being posted, and the others are in
+	// line behind it.
+	waitFor(t, "bundles to queue", func() bool {
+		return c.Statistics().BundleQueueDepth == 2
+	})
+
+	close(release)
+	c.Close()
+
+	if s := c.Statistics(); s.BundleQueueDepth != 0 ||
+		s.SuccessRequests != 3 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+	c.Close()
+
+	if n := ts.messageCount(); n != 3 {
+		t.Fatalf("Expected 3 messages posted by Close, got %d", n)
+	}
+
+	if err := c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("late")); err != ErrClientClosed {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+
+	ts = newTestServer(t)
+	defer ts.Close()
+	cfg = ts.config(t)
+	c = newTestClient(t, &cfg)
+
+	// Buffer concurrently with Close: whatever is buffered must
+	// be posted, unless dropped for want of a free worker, and
+	// whatever is refused must not be.
+	var buffered uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := c.BufferMessage(LevelInfo, time.Now(),
+					"host", "web.1", []byte("hello"))
+				if err == ErrClientClosed {
+					return
+				}
+				atomic.AddUint64(&buffered, 1)
+			}
+		}()
+	}
+
+	waitFor(t, "messages to be buffered", func() bool {
+		return atomic.LoadUint64(&buffered) >= 10
+	})
+
+	if err := c.GracefulClose(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	n := ts.messageCount() + c.Statistics().Dropped
+	if want := atomic.LoadUint64(&buffered); n != want {
+		t.Fatalf("Expected %d messages posted or dropped, got %d",
+			want, n)
+	}
+}
+
+func TestMaxMessagesPerSecond(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MaxMessagesPerSecond = 50
+	cfg.RateLimitBurst = 5
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	start := time.Now()
+	for time.Since(start) < 200*time.Millisecond {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+	}
+	elapsed := time.Since(start)
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst, plus what the bucket refilled with meanwhile.
+	limit := uint64(5 + elapsed.Seconds()*50 + 1)
+	n := ts.messageCount()
+	if n > limit || n < 5 {
+		t.Fatalf("Expected between 5 and %d messages, got %d",
+			limit, n)
+	}
+
+	s := c.Statistics()
+	if s.Dropped == 0 {
+		t.Fatalf("Expected messages over the limit dropped: %+v", s)
+	}
+
+	if s.Total != s.Successful+s.Dropped {
+		t.Fatalf("Expected every message counted in Total: %+v", s)
+	}
+}
+
+func TestRateLimitedNotDeduped(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MaxMessagesPerSecond = 20
+	cfg.DedupeWindow = time.Minute
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	buffer := func(log string) {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	bulk := func(log string) {
+		c.BulkBufferMessages([]LogEntry{{Level: LevelInfo,
+			When: time.Now(), Host: "host", ProcId: "web.1",
+			Log: []byte(log)}})
+	}
+
+	for name, send := range map[string]func(string){
+		"BufferMessage":      buffer,
+		"BulkBufferMessages": bulk,
+	} {
+		// Let the limiter fill up again.
+		time.Sleep(100 * time.Millisecond)
+		before := c.Statistics()
+		framed := c.c.Statistics().NumberFramed
+
+		// The burst goes to the first message, so the second
+		// is over the limit, and not taken for buffered.
+		send(name + " admitted")
+		send(name + " limited")
+		time.Sleep(100 * time.Millisecond)
+		send(name + " limited")
+		send(name + " limited")
+
+		s := c.Statistics()
+		if s.Dropped-before.Dropped != 1 ||
+			s.Deduped-before.Deduped != 1 ||
+			c.c.Statistics().NumberFramed-framed != 2 {
+			t.Fatalf("%s: expected one limited, one retried and "+
+				"one duplicate, from %+v to %+v", name, before, s)
+		}
+	}
+}
+
+func TestLogplexTLSServerName(t *testing.T) {
+	ts := newUnstartedTestServer(t)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	// The test certificate covers example.com as well as the
+	// address the server listens on.
+	for _, tc := range []struct {
+		serverName string
+		ok         bool
+	}{
+		{"example.com", true},
+		{"logplex.invalid", false},
+	} {
+		cfg := ts.config(t)
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+		cfg.LogplexTLSServerName = tc.serverName
+		c := newTestClient(t, &cfg)
+
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		err := c.Flush()
+		c.Close()
+
+		if tc.ok && err != nil {
+			t.Fatalf("Expected %s to verify: %v", tc.serverName, err)
+		} else if !tc.ok && err == nil {
+			t.Fatalf("Expected %s not to verify", tc.serverName)
+		}
+	}
+}
+
+func TestStatsChan(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+
+	ch := c.StatsChan(10)
+	small := c.StatsChan(1)
+
+	for i := 0; i < 2; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		c.Flush()
+	}
+
+	ts.setStatus(http.StatusBadRequest)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	c.Flush()
+	c.Close()
+
+	var got []Stats
+	for s := range ch {
+		got = append(got, s)
+	}
+
+	if len(got) != 3 || got[0].SuccessRequests != 1 ||
+		got[1].SuccessRequests != 2 || got[2].RejectRequests != 1 {
+		t.Fatalf("Expected one snapshot per post, got %+v", got)
+	}
+
+	// A full channel misses snapshots, rather than blocking.
+	n := 0
+	for range small {
+		n += 1
+	}
+
+	if n != 1 {
+		t.Fatalf("Expected 1 snapshot in the small channel, got %d", n)
+	}
+
+	if _, ok := <-c.StatsChan(1); ok {
+		t.Fatal("Expected a closed channel from a closed Client")
+	}
+}
+
+func TestMessageRetryBudget(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		<-release
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.MessageRetryBudget = 1
+	c := newTestClient(t, &cfg)
+
+	buffer := func(log string) {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	// The only worker is kept busy posting the first message, so
+	// the bundles of the others are dropped: the second message
+	// on its first and second tries, the third on its first.
+	buffer("first")
+	waitFor(t, "the worker to start", func() bool {
+		return len(c.bucket) == 0
+	})
+	buffer("second")
+	buffer("third")
+
+	if s := c.Statistics(); s.Dropped != 1 || s.DroppedRequests != 2 {
+		t.Fatalf("Expected 1 message dropped from 2 bundles, got %+v",
+			s)
+	}
+
+	close(release)
+	waitFor(t, "the worker to finish", func() bool {
+		return len(c.bucket) == cfg.Concurrency
+	})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if n := ts.messageCount(); n != 2 {
+		t.Fatalf("Expected 2 messages posted, got %d", n)
+	}
+
+	if !bytes.Contains(ts.body(1), []byte("third")) {
+		t.Fatalf("Expected the retried message, got %q", ts.body(1))
+	}
+}
+
+func TestTrackCallerInfo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.TrackCallerInfo = true
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	_, _, line, _ := runtime.Caller(0)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf(" caller=logplexc_test.go:%d hello", line+1)
+	if !bytes.HasSuffix(ts.body(0), []byte(want)) {
+		t.Fatalf("Expected %q to end with %q", ts.body(0), want)
+	}
+}
+
+func TestMessagePrefix(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.MessagePrefix = "[staging]"
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello 0"))
+
+	bulk := []LogEntry{
+		{Level: LevelInfo, When: time.Now(), Host: "host",
+			ProcId: "web.1", Log: []byte("hello 1")},
+		{Level: LevelInfo, When: time.Now(), Host: "host",
+			ProcId: "web.1", Log: []byte("hello 2")},
+	}
+	c.BulkBufferMessages(bulk)
+
+	if string(bulk[0].Log) != "hello 1" {
+		t.Fatalf("The caller's message was modified: %q", bulk[0].Log)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	for rest := ts.body(0); len(rest) > 0; i += 1 {
+		_, msg, next, err := nextFrame(rest)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", rest, err)
+		}
+
+		want := fmt.Sprintf(" - [staging] hello %d", i)
+		if !bytes.HasSuffix(msg, []byte(want)) {
+			t.Fatalf("Expected %q to end with %q", msg, want)
+		}
+
+		rest = next
+	}
+
+	if i != 3 {
+		t.Fatalf("Expected 3 messages, got %d", i)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.TargetSuccessRate = 0.5
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	if s := c.Statistics(); s.ErrorBudget != 1 || s.SLOViolated {
+		t.Fatalf("Expected a full budget to start, got %+v", s)
+	}
+
+	post := func(status int) {
+		ts.setStatus(status)
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		c.Flush()
+	}
+
+	for _, tc := range []struct {
+		status int
+		budget float64
+	}{
+		{http.StatusNoContent, 1},
+		{http.StatusNoContent, 1},
+		{http.StatusNoContent, 1},
+		{http.StatusServiceUnavailable, 0.5},
+		{http.StatusServiceUnavailable, 0.2},
+		{http.StatusServiceUnavailable, 0},
+	} {
+		post(tc.status)
+
+		s := c.Statistics()
+		if math.Abs(s.ErrorBudget-tc.budget) > 1e-9 || s.SLOViolated {
+			t.Fatalf("Expected a budget of %v, got %+v",
+				tc.budget, s)
+		}
+	}
+
+	post(http.StatusServiceUnavailable)
+	if s := c.Statistics(); s.ErrorBudget >= 0 || !s.SLOViolated {
+		t.Fatalf("Expected the budget overspent, got %+v", s)
+	}
+
+	cfg.TargetSuccessRate = 1.5
+	if _, err := NewClient(&cfg); err == nil {
+		t.Fatal("Expected an error for a target above 1")
+	}
+}
+
+func TestAdaptiveBatchSize(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.AdaptiveBatchSize = true
+	cfg.MaxRequestSizeTrigger = 110 * KB
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	post := func(n int) {
+		for i := 0; i < n; i += 1 {
+			c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+				[]byte("hello"))
+			c.Flush()
+		}
+	}
+
+	ts.setStatus(http.StatusServiceUnavailable)
+	post(30)
+
+	// Halved after each of the three rounds of ten failures.
+	if got, want := c.sizeTrigger(), 100*KB/8; got != want {
+		t.Fatalf("Expected the trigger to shrink to %d, got %d",
+			want, got)
+	}
+
+	ts.setStatus(http.StatusNoContent)
+	post(100)
+	shrunk := c.sizeTrigger()
+	post(300)
+
+	if got := c.sizeTrigger(); got <= shrunk || got > 110*KB {
+		t.Fatalf("Expected the trigger to grow from %d up to %d, "+
+			"got %d", shrunk, 110*KB, got)
+	}
+}
+
+func TestSecondaryBufferSize(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		<-release
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.SecondaryBufferSize = 10 * KB
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	buffer := func(log string) {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	buffer("first")
+	waitFor(t, "the worker to start", func() bool {
+		return len(c.bucket) == 0
+	})
+
+	// With the only worker busy, these are held back rather
+	// than dropped.
+	buffer("second")
+	buffer("third")
+
+	close(release)
+	waitFor(t, "the held back messages to be posted", func() bool {
+		return ts.requestCount() == 2
+	})
+
+	body := ts.body(1)
+	if !bytes.Contains(body, []byte("second")) ||
+		!bytes.Contains(body, []byte("third")) {
+		t.Fatalf("Expected the held back messages, got %q", body)
+	}
+
+	if s := c.Statistics(); s.Dropped != 0 {
+		t.Fatalf("Expected nothing dropped, got %+v", s)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		<-release
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.RequestSizeTrigger = 250
+	cfg.DropPolicy = DropPolicyDropOldest
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	buffer := func(log string) {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	buffer("first")
+	waitFor(t, "the worker to start", func() bool {
+		return len(c.bucket) == 0
+	})
+
+	// With the only worker busy, the older of these make room
+	// for the newer ones.
+	for i := 0; i < 10; i += 1 {
+		buffer(fmt.Sprintf("message %d", i))
+	}
+
+	close(release)
+	waitFor(t, "the newest messages to be posted", func() bool {
+		s := c.Statistics()
+		return s.Successful+s.Dropped == 11
+	})
+
+	body := ts.body(1)
+	if !bytes.Contains(body, []byte("message 9")) ||
+		bytes.Contains(body, []byte("message 0")) {
+		t.Fatalf("Expected only the newest messages, got %q", body)
+	}
+
+	s := c.Statistics()
+	if s.Dropped == 0 || s.Total != 11 {
+		t.Fatalf("Expected the oldest messages dropped, got %+v", s)
+	}
+}
+
+func TestLocalAgent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Cannot listen on a Unix socket: %v", err)
+	}
+
+	ts := newUnstartedTestServer(t)
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var seen *http.Request
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = r
+	}
+
+	cfg := ts.config(t)
+	cfg.Logplex = url.URL{
+		Scheme: "http", Host: "logplex.heroku.com", Path: "/logs",
+	}
+	cfg.LocalAgent = path
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if seen.Host != "logplex.heroku.com" || seen.URL.Path != "/logs" {
+		t.Fatalf("Unexpected request for %s%s", seen.Host, seen.URL.Path)
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	const delay = 100 * time.Millisecond
+	ts.hook = func(r *http.Request, body []byte) {
+		time.Sleep(delay)
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for _, tc := range []struct {
+		timeout time.Duration
+		err     error
+	}{
+		{delay + time.Second, nil},
+		{delay / 10, context.DeadlineExceeded},
+	} {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			tc.timeout)
+		err := c.WaitIdle(ctx)
+		cancel()
+
+		if err != tc.err {
+			t.Fatalf("Expected %v waiting %v, got %v", tc.err,
+				tc.timeout, err)
+		}
+
+		if err == nil && ts.requestCount() != 1 {
+			t.Fatal("WaitIdle returned before the post finished")
+		}
+	}
+
+	// Closing leaves nothing to wait for.
+	c.Close()
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// A server that accepts connections but never reads from
+	// them, so that writing a large body stalls.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+
+	cfg := Config{
+		Logplex: url.URL{
+			Scheme: "http", Host: l.Addr().String(),
+		},
+		Token:              testToken,
+		RequestSizeTrigger: 100 * 1024 * KB,
+		Concurrency:        1,
+		TimeTrigger:        TimeTriggerNever,
+		WriteTimeout:       100 * time.Millisecond,
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		bytes.Repeat([]byte("x"), 8*1024*KB))
+
+	err = c.Flush()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+
+	if s := c.Statistics(); s.TimeoutErrors != 1 {
+		t.Fatalf("Expected a timeout to be counted, got %+v", s)
+	}
+
+	// A Logplex that is merely slow to respond is not affected.
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.hook = func(r *http.Request, body []byte) {
+		time.Sleep(2 * cfg.WriteTimeout)
+	}
+
+	slow := ts.config(t)
+	slow.WriteTimeout = cfg.WriteTimeout
+	c = newTestClient(t, &slow)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Expected a slow response to succeed: %v", err)
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	delay := 500 * time.Millisecond
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		d := delay
+		mu.Unlock()
+		time.Sleep(d)
+	}
+
+	cfg := ts.config(t)
+	cfg.ResponseTimeout = 50 * time.Millisecond
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+
+	start := time.Now()
+	err := c.Flush()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() ||
+		!strings.Contains(err.Error(), "awaiting response") {
+		t.Fatalf("Expected a response timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Fatalf("Expected to give up before the response, took %v",
+			elapsed)
+	}
+
+	if s := c.Statistics(); s.TimeoutErrors != 1 {
+		t.Fatalf("Expected a timeout to be counted, got %+v", s)
+	}
+
+	// Responding in time is not affected.
+	mu.Lock()
+	delay = 0
+	mu.Unlock()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Expected a prompt response to succeed: %v", err)
+	}
+}
+
+func TestCurrentBundleID(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var posted []string
+	ts.hook = func(r *http.Request, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, r.Header.Get("X-Bundle-ID"))
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerNever
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	if id := c.Statistics().CurrentBundleID; id != "" {
+		t.Fatalf("Expected no bundle ID before buffering, got %q", id)
+	}
+
+	uuid := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-` +
+			`[0-9a-f]{12}$`)
+
+	var ids []string
+	for i := 0; i < 2; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+
+		id := c.Statistics().CurrentBundleID
+		if !uuid.MatchString(id) {
+			t.Fatalf("Expected a version 4 UUID, got %q", id)
+		}
+
+		if err := c.Flush(); err != nil {
+			t.Fatalf("Could not flush: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(posted) != 2 || posted[0] != ids[0] || posted[1] != ids[1] {
+		t.Fatalf("Expected X-Bundle-ID headers %v, got %v", ids, posted)
+	}
+
+	if ids[0] == ids[1] {
+		t.Fatalf("Expected a new ID for each bundle, got %v", ids)
+	}
+}
+
+func TestTopSources(t *testing.T) {
+	cfg := Config{
+		Logplex:      BogusLogplexUrl,
+		Token:        testToken,
+		TimeTrigger:  TimeTriggerNever,
+		TrackSources: true,
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	// web.N sends N messages, for 1 <= N <= 12.
+	for n := 1; n <= 12; n += 1 {
+		procId := fmt.Sprintf("web.%d", n)
+		for i := 0; i < n; i += 1 {
+			c.BufferMessage(LevelInfo, time.Now(), "host", procId,
+				[]byte("hello"))
+		}
+	}
+
+	c.BulkBufferMessages([]LogEntry{
+		{Level: LevelInfo, When: time.Now(), Host: "other",
+			ProcId: "web.1", Log: []byte("a longer message")},
+	})
+
+	top := c.Statistics().TopSources()
+	if len(top) != 10 {
+		t.Fatalf("Expected the top 10 sources, got %+v", top)
+	}
+
+	for i, s := range top {
+		want := SourceStat{
+			Host:         "host",
+			ProcId:       fmt.Sprintf("web.%d", 12-i),
+			MessageCount: uint64(12 - i),
+			ByteCount:    uint64(12-i) * uint64(len("hello")),
+		}
+
+		if s != want {
+			t.Fatalf("Expected %+v at %d, got %+v", want, i, s)
+		}
+	}
+
+	if live := c.TopSources(); !reflect.DeepEqual(live, top) {
+		t.Fatalf("Client.TopSources gave %+v, expected %+v", live, top)
+	}
+}
+
+func TestTopSourcesUntracked(t *testing.T) {
+	cfg := Config{
+		Logplex:     BogusLogplexUrl,
+		Token:       testToken,
+		TimeTrigger: TimeTriggerNever,
+	}
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	c.BulkBufferMessages([]LogEntry{{Level: LevelInfo,
+		When: time.Now(), Host: "host", ProcId: "web.2",
+		Log: []byte("hello")}})
+
+	if top := c.Statistics().TopSources(); len(top) != 0 {
+		t.Fatalf("Expected no sources without TrackSources, got %+v",
+			top)
+	}
+}
+
+func TestSourceTrackerEvicts(t *testing.T) {
+	st := newSourceTracker(2)
+	st.count("host", "web.1", 1)
+	st.count("host", "web.1", 1)
+	st.count("host", "web.2", 1)
+
+	// Makes room by forgetting web.2, the quieter.
+	st.count("host", "web.3", 1)
+
+	var top [numTopSources]SourceStat
+	if n := st.top(&top); n != 2 || top[0].ProcId != "web.1" ||
+		top[1].ProcId != "web.3" {
+		t.Fatalf("Unexpected sources %+v", top[:n])
+	}
+}
+
+func TestSourceTrackerRanks(t *testing.T) {
+	// With room for fewer sources than are ranked, every
+	// source forgotten is among the top.
+	for _, maxEntries := range []int{5, 50} {
+		st := newSourceTracker(maxEntries)
+		rng := rand.New(rand.NewSource(1))
+
+		// Skewed, so that some sources are busy and many are
+		// forgotten.
+		for i := 1; i <= 20000; i += 1 {
+			n := rng.Intn(1 + rng.Intn(200))
+			st.count("host", fmt.Sprintf("web.%d", n), 1)
+
+			if i%500 == 0 {
+				checkTopSources(t, st)
+			}
+		}
+	}
+}
+
+func checkTopSources(t *testing.T, st *sourceTracker) {
+	var all []SourceStat
+	for _, s := range st.sources {
+		all = append(all, s.SourceStat)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return moreMessages(&all[i], &all[j])
+	})
+
+	if len(all) > numTopSources {
+		all = all[:numTopSources]
+	}
+
+	var top [numTopSources]SourceStat
+	n := st.top(&top)
+	if !reflect.DeepEqual(top[:n], all) {
+		t.Fatalf("Expected top sources %+v, got %+v", all, top[:n])
+	}
+
+	// The next to be forgotten ranks below every other source.
+	for _, s := range st.sources {
+		if s != st.heap[0] && moreMessages(
+			&st.heap[0].SourceStat, &s.SourceStat) {
+			t.Fatalf("Expected %+v to be forgotten before %+v",
+				s.SourceStat, st.heap[0].SourceStat)
+		}
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	ts := newUnstartedTestServer(t)
+
+	var conns int32
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+
+	ts.Start()
+	defer ts.Close()
+
+	for _, disable := range []bool{false, true} {
+		atomic.StoreInt32(&conns, 0)
+
+		cfg := ts.config(t)
+		cfg.HttpClient.Transport = nil
+		cfg.MaxIdleConns = 4
+		cfg.IdleConnTimeout = time.Minute
+		cfg.DisableKeepAlives = disable
+		c := newTestClient(t, &cfg)
+
+		for i := 0; i < 3; i += 1 {
+			c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+				[]byte("hello"))
+			if err := c.Flush(); err != nil {
+				t.Fatalf("Could not flush: %v", err)
+			}
+		}
+		c.Close()
+		c.c.CloseIdleConnections()
+
+		want := int32(1)
+		if disable {
+			want = 3
+		}
+
+		if n := atomic.LoadInt32(&conns); n != want {
+			t.Fatalf("DisableKeepAlives %v: expected %d "+
+				"connections, got %d", disable, want, n)
+		}
+	}
+}
+
+func TestEscapePolicy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	invalid := []byte("core\xff\xfedump")
+	for i, tc := range []struct {
+		policy EscapePolicy
+		want   []byte
+	}{
+		{EscapeNone, invalid},
+		{EscapeInvalid, []byte("core\uFFFDdump")},
+		{EscapeBase64, []byte("Y29yZf/+ZHVtcA==")},
+	} {
+		cfg := ts.config(t)
+		cfg.EscapePolicy = tc.policy
+		c := newTestClient(t, &cfg)
+
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1", invalid)
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("valid ☃"))
+		c.BulkBufferMessages([]LogEntry{{Level: LevelInfo,
+			When: time.Now(), Host: "host", ProcId: "web.1",
+			Log: invalid}})
+		if err := c.Flush(); err != nil {
+			t.Fatalf("Could not flush: %v", err)
+		}
+		c.Close()
+
+		body := ts.body(i)
+		if bytes.Count(body, tc.want) != 2 ||
+			!bytes.Contains(body, []byte(" - valid ☃")) {
+			t.Fatalf("Policy %d: expected %q twice in %q",
+				tc.policy, tc.want, body)
+		}
+
+		want := uint64(2)
+		if tc.policy == EscapeNone {
+			want = 0
+		}
+
+		if s := c.Statistics(); s.EscapedMessages != want {
+			t.Fatalf("Policy %d: expected %d escaped, got %d",
+				tc.policy, want, s.EscapedMessages)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	tokens := make(map[string]int)
+	ts.hook = func(r *http.Request, body []byte) {
+		_, token, _ := r.BasicAuth()
+
+		mu.Lock()
+		defer mu.Unlock()
+		tokens[token] += 1
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerPeriodic
+	cfg.Period = 10 * time.Millisecond
+	parent := newTestClient(t, &cfg)
+	defer parent.Close()
+
+	overrides := ts.config(t)
+	overrides.Token = "t.11111111-1111-1111-1111-111111111111"
+	clone, err := parent.Clone(&overrides)
+	if err != nil {
+		t.Fatalf("Could not clone: %v", err)
+	}
+
+	if clone.bucket != parent.bucket {
+		t.Fatal("Expected the clone to share the parent's workers")
+	}
+
+	// Flushed by the parent's ticker, with the clone's token.
+	clone.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("from the clone"))
+	waitFor(t, "the clone to be flushed", func() bool {
+		return clone.Statistics().Successful == 1
+	})
+
+	mu.Lock()
+	if tokens[overrides.Token] != 1 || tokens[testToken] != 0 {
+		t.Fatalf("Expected a post with the clone's token, got %v",
+			tokens)
+	}
+	mu.Unlock()
+
+	clone.Close()
+	if err := parent.BufferMessage(LevelInfo, time.Now(), "host",
+		"web.1", []byte("from the parent")); err != nil {
+		t.Fatalf("Parent affected by closing its clone: %v", err)
+	}
+
+	if err := parent.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	if s := parent.Statistics(); s.Successful != 1 {
+		t.Fatalf("Expected only the parent's message, got %+v", s)
+	}
+
+	// Closing the parent closes, and so flushes, its clones.
+	other, err := parent.Clone(&overrides)
+	if err != nil {
+		t.Fatalf("Could not clone: %v", err)
+	}
+
+	other.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("flushed on close"))
+	parent.Close()
+
+	err = other.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("too late"))
+	if err != ErrClientClosed {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+
+	if s := other.Statistics(); s.Successful != 1 {
+		t.Fatalf("Expected the clone flushed on close, got %+v", s)
+	}
+
+	if _, err := parent.Clone(&overrides); err != ErrClientClosed {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestNewUnixClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drain.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Cannot listen on a Unix socket: %v", err)
+	}
+
+	ts := newUnstartedTestServer(t)
+	ts.Listener.Close()
+	ts.Listener = l
+
+	var opened, closed int32
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&opened, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+
+	ts.Start()
+	defer ts.Close()
+
+	c, err := NewUnixClient(path, &Config{
+		Token:              testToken,
+		RequestSizeTrigger: 100 * KB,
+		Concurrency:        1,
+		TimeTrigger:        TimeTriggerNever,
+	})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("over the socket"))
+	c.Close()
+
+	if n := ts.messageCount(); n != 1 {
+		t.Fatalf("Expected one message flushed on Close, got %d", n)
+	}
+
+	if !bytes.HasSuffix(ts.body(0), []byte(" web.1 - - over the socket")) {
+		t.Fatalf("Unexpected framing %q", ts.body(0))
+	}
+
+	waitFor(t, "the socket to be closed", func() bool {
+		return atomic.LoadInt32(&opened) == 1 &&
+			atomic.LoadInt32(&closed) == 1
+	})
+}
+
+func TestFlushOnShutdownSignal(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	// Handle the signal here too, as the Client delivers it again
+	// once closed, which would otherwise end the test.
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	cfg := ts.config(t)
+	cfg.FlushOnShutdownSignal = []os.Signal{syscall.SIGHUP}
+	cfg.ShutdownTimeout = time.Second
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("flushed on signal"))
+
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(syscall.SIGHUP)
+	}
+	if err != nil {
+		t.Skipf("Cannot signal self: %v", err)
+	}
+
+	waitFor(t, "the signal to close the Client", func() bool {
+		return c.closed()
+	})
+
+	if n := ts.messageCount(); n != 1 {
+		t.Fatalf("Expected the message flushed, got %d", n)
+	}
+
+	// Both the original signal and the one delivered again.
+	for i := 0; i < 2; i += 1 {
+		select {
+		case <-sigs:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected signal %d to be delivered", i+1)
+		}
+	}
+}
+
+func TestTokenAndDrainURL(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Logplex: BogusLogplexUrl, Token: testToken}, ""},
+		{Config{Logplex: BogusLogplexUrl, Token: "t.short"},
+			"token is not of the form"},
+		{Config{Logplex: BogusLogplexUrl, Token: "a-token-" + testToken},
+			"token is not of the form"},
+		{Config{Logplex: BogusLogplexUrl}, "token is not of the form"},
+		{Config{DrainURL: "https://token:" + testToken +
+			"@logplex.example.com/logs"}, ""},
+		{Config{DrainURL: "https://logplex.example.com/logs",
+			Token: testToken}, ""},
+		{Config{DrainURL: "https://logplex.example.com/logs"},
+			"token is not of the form"},
+		{Config{DrainURL: "http://logplex.example.com/logs",
+			Token: testToken}, "not an https URL"},
+		{Config{DrainURL: "https:///logs", Token: testToken},
+			"not an https URL"},
+		{Config{DrainURL: "https://logplex.example.com/logs",
+			Logplex: BogusLogplexUrl, Token: testToken},
+			"only one of"},
+	} {
+		c, err := NewClient(&tc.cfg)
+		if tc.want == "" {
+			if err != nil {
+				t.Fatalf("Unexpected error for %+v: %v",
+					tc.cfg, err)
+			}
+
+			c.Close()
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("Expected an error about %q for %+v, got %v",
+				tc.want, tc.cfg, err)
+		}
+	}
+
+	// The token is not echoed in errors.
+	_, err := NewClient(&Config{Logplex: BogusLogplexUrl,
+		Token: "secret"})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("Expected an error without the token, got %v", err)
+	}
+}
+
+func TestStatsFormats(t *testing.T) {
+	// Give every exported field a distinct value.
+	var s Stats
+	v := reflect.ValueOf(&s).Elem()
+	for i := 0; i < v.NumField(); i += 1 {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.Int, reflect.Int32:
+			f.SetInt(int64(i + 1))
+		case reflect.Uint64:
+			f.SetUint(uint64(i + 1))
+		case reflect.Float64:
+			f.SetFloat(float64(i) + 0.5)
+		case reflect.String:
+			f.SetString(fmt.Sprintf("string %d", i))
+		case reflect.Bool:
+			f.SetBool(true)
+		default:
+			t.Fatalf("Untested kind of field %s",
+				v.Type().Field(i).Name)
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Could not encode: %v", err)
+	}
+
+	var keys map[string]interface{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		t.Fatalf("Could not decode %s: %v", data, err)
+	}
+
+	for _, key := range []string{
+		"totalRequests", "successful", "http2Requests",
+		"currentBundleId", "sloViolated",
+	} {
+		if _, ok := keys[key]; !ok {
+			t.Errorf("Expected key %q in %s", key, data)
+		}
+	}
+
+	if _, ok := keys["TotalRequests"]; ok {
+		t.Errorf("Unexpected field name as key in %s", data)
+	}
+
+	var decoded Stats
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Could not decode %s: %v", data, err)
+	}
+
+	if decoded != s {
+		t.Fatalf("Stats did not round-trip: %#v, expected %#v",
+			decoded, s)
+	}
+
+	want := fmt.Sprintf("total=%d ok=%d dropped=%d cancelled=%d "+
+		"rejected=%d concurrency=%d", s.Total, s.Successful,
+		s.Dropped, s.Cancelled, s.Rejected, s.Concurrency)
+	if got := s.String(); got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+
+	if got := fmt.Sprintf("%v", s); got != want {
+		t.Fatalf("Expected %%v to give %q, got %q", want, got)
+	}
+
+	// Failure messages print every field.
+	if got := fmt.Sprintf("%+v", s); !strings.Contains(got,
+		fmt.Sprintf("TotalPosts:%d", s.TotalPosts)) {
+		t.Fatalf("Expected every field from %%+v, got %q", got)
+	}
+}
+
+func TestClientStatsMethods(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	// Post all the while, for the race detector to catch any
+	// reads of the counters without statLock.
+	done := make(chan struct{})
+	posting := make(chan struct{})
+	go func() {
+		defer close(posting)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.BufferMessage(LevelInfo, time.Now(), "host",
+					"web.1", []byte("hello"))
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i += 1 {
+		if !strings.HasPrefix(fmt.Sprint(c), "total=") {
+			t.Fatalf("Unexpected summary %q", fmt.Sprint(c))
+		}
+
+		if !strings.Contains(fmt.Sprintf("%+v", c), "TotalPosts:") {
+			t.Fatalf("Unexpected fields %+v", c)
+		}
+
+		data, err := json.Marshal(c)
+		if err != nil || !bytes.Contains(data, []byte(`"totalPosts"`)) {
+			t.Fatalf("Unexpected encoding %s: %v", data, err)
+		}
+	}
+
+	close(done)
+	<-posting
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	before := c.Statistics()
+	if err := json.Unmarshal([]byte(`{"total":0}`), c); err == nil {
+		t.Fatal("Expected an error decoding into a Client")
+	}
+
+	if after := c.Statistics(); after.Total != before.Total {
+		t.Fatalf("Decoding changed Total from %d to %d",
+			before.Total, after.Total)
+	}
+}
+
+func TestAvgTTFBMillis(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	const delay = 100 * time.Millisecond
+	ts.hook = func(r *http.Request, body []byte) {
+		time.Sleep(delay)
+	}
+
+	cfg := ts.config(t)
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 5; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("hello"))
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// At least the delay, but a loaded machine can add to it.
+	want := float64(delay / time.Millisecond)
+	got := c.Statistics().AvgTTFBMillis
+	if got < want || got > 5*want {
+		t.Fatalf("Expected a TTFB from %vms to %vms, got %vms",
+			want, 5*want, got)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	newClient := func() *Client {
+		cfg := Config{
+			Logplex:     BogusLogplexUrl,
+			Token:       testToken,
+			TimeTrigger: TimeTriggerNever,
+		}
+		return newTestClient(t, &cfg)
+	}
+
+	web, worker := newClient(), newClient()
+	defer web.Close()
+	defer worker.Close()
+
+	if err := Register("test-web", web); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister("test-web")
+
+	if err := Register("test-worker", worker); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister("test-worker")
+
+	if err := Register("test-web", worker); err == nil {
+		t.Fatal("Expected an error registering a name twice")
+	}
+
+	if c, ok := Lookup("test-web"); !ok || c != web {
+		t.Fatalf("Expected to look up the web Client, got %p", c)
+	}
+
+	worker.Close()
+	if _, ok := Lookup("test-worker"); ok {
+		t.Fatal("Expected a Closed Client to be unregistered")
+	}
+
+	all := All()
+	if len(all) != 1 || all["test-web"] != web {
+		t.Fatalf("Expected only the web Client, got %v", all)
+	}
+
+	Unregister("test-web")
+	if _, ok := Lookup("test-web"); ok {
+		t.Fatal("Expected the web Client to be unregistered")
+	}
+}
+
+// A bytes.Buffer safe to write and read at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestDropWarnThreshold(t *testing.T) {
+	var logged syncBuffer
+	cfg := Config{
+		Logplex:           BogusLogplexUrl,
+		Token:             testToken,
+		TimeTrigger:       TimeTriggerImmediate,
+		DropWarnThreshold: 0.5,
+		Logger:            log.New(&logged, "", 0),
+	}
+
+	// With no workers, every message is dropped.
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for i := 0; i < 4; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("dropped"))
+	}
+
+	waitFor(t, "a warning", func() bool {
+		return logged.String() != ""
+	})
+
+	line := logged.String()
+	if !strings.Contains(line, "warning: dropped 100.0% of 4 "+
+		"messages in the last minute, above 50.0%") ||
+		!strings.Contains(line, BogusLogplexUrl.Host) ||
+		strings.Contains(line, testToken) {
+		t.Fatalf("Unexpected warning %q", line)
+	}
+
+	if _, err := NewClient(&Config{Logplex: BogusLogplexUrl,
+		Token: testToken, DropWarnThreshold: 2}); err == nil {
+		t.Fatal("Expected an error for a threshold above 1")
+	}
+}
+
+func TestDropWatch(t *testing.T) {
+	dw := newDropWatch(0.5, time.Minute, nil,
+		"https://logplex.example.com/logs")
+
+	start := time.Now()
+	check := func(at time.Duration, total, dropped uint64) string {
+		return dw.check(start.Add(at), total, dropped)
+	}
+
+	if line := check(0, 0, 0); line != "" {
+		t.Fatalf("Expected nothing to warn of, got %q", line)
+	}
+
+	line := check(time.Second, 4, 3)
+	if !strings.Contains(line, "warning: dropped 75.0% of 4 messages") {
+		t.Fatalf("Expected a warning, got %q", line)
+	}
+
+	// Not repeated until the cooldown has passed.
+	if line := check(2*time.Second, 8, 7); line != "" {
+		t.Fatalf("Expected no warning within the cooldown, got %q",
+			line)
+	}
+
+	if line := check(time.Minute+time.Second, 8, 7); line == "" {
+		t.Fatal("Expected a warning after the cooldown")
+	}
+
+	// Noted once when the rate falls back.
+	line = check(time.Minute+2*time.Second, 100, 7)
+	if !strings.Contains(line, "info: dropped 7.0% of 100 messages") {
+		t.Fatalf("Expected the recovery to be noted, got %q", line)
+	}
+
+	if line := check(time.Minute+3*time.Second, 200, 7); line != "" {
+		t.Fatalf("Expected nothing more, got %q", line)
+	}
+
+	// Only the last minute counts: once the early drops are out
+	// of the window, a few more drops make for a high rate.
+	for i := 0; i < rateWindowSeconds; i += 1 {
+		check(2*time.Minute, 200, 7)
+	}
+
+	line = check(2*time.Minute, 202, 9)
+	if !strings.Contains(line, "warning: dropped 100.0% of 2 messages") {
+		t.Fatalf("Expected a warning for the last minute, got %q",
+			line)
+	}
+}
+
+func TestFallbackWriter(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.setStatus(http.StatusServiceUnavailable)
+
+	var fallback bytes.Buffer
+	cfg := ts.config(t)
+	cfg.RecoverOnError = true
+	cfg.MaxRecoveryMessages = 1
+	cfg.FallbackWriter = &fallback
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	for _, log := range []string{"first", "second"} {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte(log))
+	}
+
+	// Only the message that is not recovered is written.
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	lines := strings.Split(fallback.String(), "\n")
+	if len(lines) != 2 || lines[1] != "" ||
+		!strings.HasPrefix(lines[0], "<134>1 ") ||
+		!strings.HasSuffix(lines[0],
+			" host "+testToken+" web.1 - - second") {
+		t.Fatalf("Unexpected fallback output %q", fallback.String())
+	}
+
+	// The recovered message is written once it fails again.
+	fallback.Reset()
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	if !strings.HasSuffix(fallback.String(), " - - first\n") {
+		t.Fatalf("Unexpected fallback output %q", fallback.String())
+	}
+}
+
+// An io.Writer that blocks until released.
+type stuckWriter chan struct{}
+
+func (sw stuckWriter) Write(p []byte) (int, error) {
+	<-sw
+	return len(p), nil
+}
+
+func TestFallbackWriteTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.setStatus(http.StatusForbidden)
+
+	stuck := make(stuckWriter)
+	defer close(stuck)
+
+	cfg := ts.config(t)
+	cfg.FallbackWriter = stuck
+	cfg.FallbackWriteTimeout = 10 * time.Millisecond
+	c := newTestClient(t, &cfg)
+	defer c.Close()
+
+	// The first write is abandoned, and the second skipped for
+	// the first still being stuck; neither holds up the flush
+	// for long.
+	for i := 0; i < 2; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("lost"))
+
+		start := time.Now()
+		if err := c.Flush(); err == nil {
+			t.Fatal("Expected the flush to fail")
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Flush held up for %v", elapsed)
+		}
+	}
+
+	if s := c.Statistics(); s.FallbackSkipped != 2 || s.Rejected != 2 {
+		t.Fatalf("Expected 2 rejected and skipped, got %+v", s)
+	}
+}
+
+func TestMaxQueuedBundles(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		<-release
+	}
+
+	// A worker is left free, but must not be used.
+	cfg := ts.config(t)
+	cfg.Concurrency = 2
+	cfg.TimeTrigger = TimeTriggerImmediate
+	cfg.MaxQueuedBundles = 1
+	c := newTestClient(t, &cfg)
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("posted"))
+	waitFor(t, "the queue to fill", func() bool {
+		return c.Statistics().QueueDepth == 1
+	})
+
+	for i := 0; i < 3; i += 1 {
+		c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("dropped"))
+	}
+
+	if s := c.Statistics(); s.Dropped != 3 || s.QueueDepth != 1 {
+		t.Fatalf("Expected 3 dropped with one bundle queued, "+
+			"got %+v", s)
+	}
+
+	close(release)
+	c.Close()
+
+	if s := c.Statistics(); s.QueueDepth != 0 ||
+		s.SuccessRequests != 1 || ts.messageCount() != 1 {
+		t.Fatalf("Unexpected statistics: %+v", s)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var logged bytes.Buffer
+	cfg := ts.config(t)
+	cfg.MaxConsecutiveErrors = 1
+	cfg.SlogLogger = slog.New(slog.NewTextHandler(&logged,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := newTestClient(t, &cfg)
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.setStatus(http.StatusServiceUnavailable)
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	// A post that fails outright counts towards reconnecting.
+	ts.Close()
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+	if err := c.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	c.Close()
+
+	out := logged.String()
+	for _, want := range []string{
+		`level=DEBUG msg="logplexc: posting bundle" endpoint=`,
+		"bundle_messages=1 bundle_bytes=",
+		`level=WARN msg="logplexc: post rejected" status_code=503 ` +
+			"bundle_messages=1",
+		`level=WARN msg="logplexc: post failed" error=`,
+		`level=WARN msg="logplexc: reconnecting after consecutive ` +
+			`failures" consecutive_errors=1`,
+		`level=INFO msg="logplexc: closed" stats.total=3 ` +
+			"stats.successful=1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in the log:\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(out, testToken) {
+		t.Errorf("Token logged:\n%s", out)
+	}
+}
+
+func TestClientLogValue(t *testing.T) {
+	c := newTestClient(t, &Config{
+		Logplex:     BogusLogplexUrl,
+		Token:       testToken,
+		TimeTrigger: TimeTriggerNever,
+	})
+	defer c.Close()
+
+	c.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+		[]byte("hello"))
+
+	var logged bytes.Buffer
+	slog.New(slog.NewTextHandler(&logged, nil)).Info("status",
+		slog.Any("client", c))
+
+	if !strings.Contains(logged.String(), "client.total=1 ") {
+		t.Fatalf("Expected the Client's Statistics in %q",
+			logged.String())
+	}
+}
+
+func TestSlogLoggerUnset(t *testing.T) {
+	c := newTestClient(t, &Config{
+		Logplex: BogusLogplexUrl,
+		Token:   testToken,
+	})
+	defer c.Close()
+
+	b := c.c.SwapBundle()
+	defer c.c.ReleaseBundle(b)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.logPost(b)
+		c.logRejected(b, http.StatusServiceUnavailable)
+	})
+	if allocs != 0 {
+		t.Fatalf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestCloneCloseReturnsToken(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.hook = func(r *http.Request, body []byte) {
+		entered <- struct{}{}
+		<-release
+	}
+
+	cfg := ts.config(t)
+	cfg.TimeTrigger = TimeTriggerImmediate
+	parent := newTestClient(t, &cfg)
+	defer parent.Close()
+
+	// Whether the token was lost used to be a coin toss, so toss
+	// it a few times.
+	for i := 0; i < 10; i += 1 {
+		overrides := cfg
+		clone, err := parent.Clone(&overrides)
+		if err != nil {
+			t.Fatalf("Could not clone: %v", err)
+		}
+
+		clone.BufferMessage(LevelInfo, time.Now(), "host", "web.1",
+			[]byte("in flight"))
+		<-entered
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			clone.Close()
+		}()
+
+		// Let the post finish only once the clone is
+		// shutting down.
+		waitFor(t, "the clone to shut down", clone.closed)
+		release <- struct{}{}
+		<-closed
+
+		if n := len(parent.bucket); n != cap(parent.bucket) {
+			t.Fatalf("Parent left with %d of %d tokens", n,
+				cap(parent.bucket))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := parent.WaitIdle(ctx); err != nil {
+		t.Fatalf("Parent never idle: %v", err)
+	}
+}
@@ -2,10 +2,16 @@ package logplexc
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,8 +33,70 @@ type MiniConfig struct {
 	Logplex    url.URL
 	Token      string
 	HttpClient http.Client
+
+	// Optional: source of Bundles.  A private pool is created
+	// when nil.
+	BundlePool *BundlePool
+
+	// Optional: base64-encode hostnames that are not printable
+	// ASCII, as RFC 5424 requires of the HOSTNAME field.
+	// Otherwise, hostnames are framed as they are passed.
+	EncodeHostAsBase64 bool
+
+	// Optional: set the MSGID of each message to the part of its
+	// procId before the first '.' or '/', e.g. "web" for "web.1".
+	// Otherwise, MSGID is NILVALUE.
+	MsgIDFromProcId bool
+
+	// Optional: headers added to every post, e.g. for a proxy in
+	// front of Logplex.  Content-Type, Authorization and
+	// Logplex-Msg-Count are set by logplexc, and are ignored with
+	// a warning.  CustomHeaders take precedence over
+	// RequestMetadata.
+	RequestMetadata map[string]string
+	CustomHeaders   map[string]string
+}
+
+// Headers set by logplexc itself, which RequestMetadata and
+// CustomHeaders cannot replace.
+var reservedHeaders = []string{
+	"Content-Type", "Authorization", "Logplex-Msg-Count", "X-Bundle-ID",
+}
+
+// Merge maps of static headers, later ones taking precedence, and
+// leaving out reserved headers.
+func staticHeaders(maps ...map[string]string) http.Header {
+	h := make(http.Header)
+
+	for _, m := range maps {
+		for k, v := range m {
+			if isReservedHeader(k) {
+				log.Printf("logplexc.MiniClient: ignoring "+
+					"header %q, which logplexc sets itself", k)
+				continue
+			}
+
+			h.Set(k, v)
+		}
+	}
+
+	return h
+}
+
+func isReservedHeader(k string) bool {
+	for _, r := range reservedHeaders {
+		if strings.EqualFold(k, r) {
+			return true
+		}
+	}
+
+	return false
 }
 
+// Initial capacity of Bundles in the private pool of a MiniClient
+// that is not passed a BundlePool.
+const defaultBundleCapacity = 4096
+
 // A bundle of messages that are either being accrued to or in the
 // progress of being sent.
 //
@@ -38,6 +106,166 @@ type MiniConfig struct {
 type Bundle struct {
 	MiniStats
 	outbox bytes.Buffer
+
+	// For each message, in order, how many times it has been
+	// buffered again after failing to be delivered.
+	attempts []int
+
+	// A random UUID, assigned when the first message is buffered.
+	id string
+
+	// How many request bodies reading the Bundle are still open,
+	// less one once it has been Put back to pool.  Whichever of
+	// the Put and the last body's Close takes this below zero
+	// recycles the Bundle.
+	holds int32
+	pool  *BundlePool
+}
+
+// The UUID of the Bundle, sent as the X-Bundle-ID header when it is
+// posted.  Empty until a message is buffered to the Bundle.
+func (b *Bundle) ID() string {
+	return b.id
+}
+
+// The number of messages of the Bundle that have been buffered again
+// at least once.
+func (b *Bundle) retried() (n uint64) {
+	for _, a := range b.attempts {
+		if a > 0 {
+			n += 1
+		}
+	}
+
+	return n
+}
+
+// Assign the Bundle its UUID, if it does not have one yet.
+func (b *Bundle) begin() {
+	if b.id == "" {
+		b.id = newBundleID()
+	}
+}
+
+// Make a random (version 4) UUID.
+func newBundleID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return ""
+	}
+
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10],
+		u[10:])
+}
+
+// Remove the messages for which keep is false, returning how many
+// were removed.  Kept messages are left in order, and the Bundle is
+// compacted in place.
+//
+// Should the Bundle's contents ever fail to parse, the remainder is
+// left as it is.
+func (b *Bundle) filter(keep func(msg []byte) bool) (removed uint64) {
+	data := b.outbox.Bytes()
+	rest := data
+	w := 0
+	kept := 0
+
+	for r := 0; len(rest) > 0; r += 1 {
+		whole, msg, next, err := nextFrame(rest)
+		if err != nil {
+			w += copy(data[w:], rest)
+			kept += copy(b.attempts[kept:], b.attempts[r:])
+			break
+		}
+
+		if keep(msg) {
+			w += copy(data[w:], whole)
+			b.attempts[kept] = b.attempts[r]
+			kept += 1
+		} else {
+			removed += 1
+		}
+
+		rest = next
+	}
+
+	b.outbox.Truncate(w)
+	b.attempts = b.attempts[:kept]
+	b.NumberFramed -= removed
+	b.Buffered = b.outbox.Len()
+
+	return removed
+}
+
+// Remove up to the first n messages of the Bundle, returning what was
+// removed.
+func (b *Bundle) trimFront(n int) (removed MiniStats) {
+	rest := b.outbox.Bytes()
+	for ; n > 0 && len(rest) > 0; n -= 1 {
+		whole, _, next, err := nextFrame(rest)
+		if err != nil {
+			break
+		}
+
+		removed.NumberFramed += 1
+		removed.Buffered += len(whole)
+		rest = next
+	}
+
+	b.outbox.Next(removed.Buffered)
+	k := int(removed.NumberFramed)
+	b.attempts = b.attempts[:copy(b.attempts, b.attempts[k:])]
+	b.NumberFramed -= removed.NumberFramed
+	b.Buffered = b.outbox.Len()
+
+	return removed
+}
+
+// How many of the first messages of the Bundle have to go for the
+// rest to be size bytes or fewer, always leaving the last message.
+func (b *Bundle) overflow(size int) int {
+	n := 0
+	over := b.Buffered - size
+	rest := b.outbox.Bytes()
+	for over > 0 && uint64(n+1) < b.NumberFramed {
+		whole, _, next, err := nextFrame(rest)
+		if err != nil {
+			break
+		}
+
+		over -= len(whole)
+		n += 1
+		rest = next
+	}
+
+	return n
+}
+
+// Call fn with each message of the Bundle, in order, without its
+// length prefix.
+func (b *Bundle) each(fn func(msg []byte)) {
+	rest := b.outbox.Bytes()
+	for len(rest) > 0 {
+		_, msg, next, err := nextFrame(rest)
+		if err != nil {
+			return
+		}
+
+		fn(msg)
+		rest = next
+	}
+}
+
+// The framed messages of the Bundle, exactly as they are posted to
+// Logplex.
+//
+// The returned slice aliases the Bundle's storage: it is only valid
+// until the Bundle is released or buffered to again.
+func (b *Bundle) Bytes() []byte {
+	return b.outbox.Bytes()
 }
 
 // Client context: generally, at a minimum, one should exist per
@@ -48,28 +276,61 @@ type MiniClient struct {
 
 	reqInFlight sync.WaitGroup
 
+	// Merged RequestMetadata and CustomHeaders.
+	headers http.Header
+
 	// Messages that have been collected but not yet sent.
 	bSwapLock sync.Mutex
 	b         *Bundle
 }
 
+// Create a MiniClient.
+//
+// An error is returned if the configuration cannot possibly be used
+// to post to Logplex.
 func NewMiniClient(cfg *MiniConfig) (client *MiniClient, err error) {
-	c := MiniClient{}
+	if cfg.Token == "" {
+		return nil, errors.New("logplexc.MiniClient: empty token")
+	}
 
-	c.b = &Bundle{outbox: bytes.Buffer{}}
+	switch cfg.Logplex.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("logplexc.MiniClient: unsupported "+
+			"logplex url scheme %q", cfg.Logplex.Scheme)
+	}
+
+	if cfg.Logplex.Host == "" {
+		return nil, errors.New(
+			"logplexc.MiniClient: logplex url has no host")
+	}
+
+	c := MiniClient{}
 
 	// Make a private copy
 	c.MiniConfig = *cfg
 
-	// If the username and password weren't part of the URL, use
-	// the logplex-token as the password
-	if c.Logplex.User == nil {
-		c.Logplex.User = url.UserPassword("token", c.Token)
+	if c.BundlePool == nil {
+		c.BundlePool = NewBundlePool(defaultBundleCapacity)
 	}
 
+	c.b = c.BundlePool.Get()
+	c.headers = staticHeaders(c.RequestMetadata, c.CustomHeaders)
+	c.Logplex = withCredentials(c.Logplex, c.Token)
+
 	return &c, nil
 }
 
+// If the username and password weren't part of the URL, use the
+// logplex-token as the password.
+func withCredentials(logplex url.URL, token string) url.URL {
+	if logplex.User == nil {
+		logplex.User = url.UserPassword("token", token)
+	}
+
+	return logplex
+}
+
 // Unsynchronized statistics gathering function
 //
 // Useful as a subroutine for procedures that already have taken care
@@ -89,18 +350,18 @@ func (c *MiniClient) Statistics() MiniStats {
 // Buffer a message for best-effort delivery to Logplex
 //
 // Return the critical statistics on what has been buffered so far so
-// that the caller can opt to PostMessages() and empty the buffer.
+// that the caller can opt to SwapBundle() and Post() the buffer.
 //
 // No effort is expended to clean up bad bytes disallowed by syslog,
 // as Logplex has a length-prefixed format and the intention that each
 // Client will only process messages for a single user/security
 // context, so at worst it seems a buggy or malicious emitter of logs
-// can cause problems for themselves only.
+// can cause problems for themselves only.  The exception is the host,
+// which can be encoded if so configured (see EncodeHostAsBase64), or
+// cleaned up beforehand with NormalizeHost.
 func (c *MiniClient) BufferMessage(
 	when time.Time, host string, procId string, log []byte) MiniStats {
-	ts := when.UTC().Format(time.RFC3339)
-	syslogPrefix := "<134>1 " + ts + " " + host + " " +
-		c.Token + " " + procId + " - - "
+	syslogPrefix := c.syslogPrefix(when, host, procId)
 	msgLen := len(syslogPrefix) + len(log)
 
 	// Avoid racing against other operations that may want to swap
@@ -108,44 +369,263 @@ func (c *MiniClient) BufferMessage(
 	c.bSwapLock.Lock()
 	defer c.bSwapLock.Unlock()
 
-	fmt.Fprintf(&c.b.outbox, "%d %s%s", msgLen, syslogPrefix, log)
-	c.b.NumberFramed += 1
-	c.b.Buffered = c.b.outbox.Len()
+	frame(c.b, msgLen, syslogPrefix, log)
+
+	return unsyncStats(c.b)
+}
+
+// Buffer a batch of messages, as BufferMessage would each of them,
+// but taking the lock on the current bundle only once.  Levels are
+// ignored.
+func (c *MiniClient) BufferMessages(msgs []LogEntry) MiniStats {
+	// Render headers before taking the lock, to keep the
+	// critical section short.
+	prefixes := make([]string, len(msgs))
+	for i := range msgs {
+		prefixes[i] = c.syslogPrefix(msgs[i].When, msgs[i].Host,
+			msgs[i].ProcId)
+	}
+
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	for i := range msgs {
+		frame(c.b, len(prefixes[i])+len(msgs[i].Log), prefixes[i],
+			msgs[i].Log)
+	}
 
 	return unsyncStats(c.b)
 }
 
-func (c *MiniClient) SwapBundle() Bundle {
+// Unsynchronized framing of a message into a Bundle.
+func frame(b *Bundle, msgLen int, syslogPrefix string, log []byte) {
+	b.begin()
+	fmt.Fprintf(&b.outbox, "%d %s%s", msgLen, syslogPrefix, log)
+	b.NumberFramed += 1
+	b.Buffered = b.outbox.Len()
+	b.attempts = append(b.attempts, 0)
+}
+
+// Buffer again, as they were framed, the messages of a Bundle for
+// which again is true of the number of times they have already been
+// buffered again.  Returns how many messages, and how many bytes of
+// them, were buffered.
+func (c *MiniClient) rebuffer(b *Bundle,
+	again func(attempts int) bool) (moved MiniStats) {
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	rest := b.outbox.Bytes()
+	for i := 0; len(rest) > 0; i += 1 {
+		whole, _, next, err := nextFrame(rest)
+		if err != nil {
+			break
+		}
+
+		if again(b.attempts[i]) {
+			c.b.begin()
+			c.b.outbox.Write(whole)
+			c.b.NumberFramed += 1
+			c.b.attempts = append(c.b.attempts, b.attempts[i]+1)
+			moved.NumberFramed += 1
+			moved.Buffered += len(whole)
+		}
+
+		rest = next
+	}
+
+	c.b.Buffered = c.b.outbox.Len()
+
+	return moved
+}
+
+// Remove the first, and so oldest, n messages of the current bundle,
+// returning the statistics of what was removed.
+func (c *MiniClient) TrimOldest(n int) MiniStats {
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	return c.b.trimFront(n)
+}
+
+// The UUID of the current bundle, or empty if nothing has been
+// buffered to it yet.
+func (c *MiniClient) currentBundleID() string {
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	return c.b.id
+}
+
+// Remove the oldest messages of the current bundle until it is size
+// bytes or fewer, or only the newest message is left.
+func (c *MiniClient) trimTo(size int) MiniStats {
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	return c.b.trimFront(c.b.overflow(size))
+}
+
+// Render the syslog header of a message, up to and including the
+// space that separates it from the message body.
+func (c *MiniClient) syslogPrefix(
+	when time.Time, host string, procId string) string {
+	ts := when.UTC().Format(time.RFC3339)
+
+	if c.EncodeHostAsBase64 {
+		host = encodeHost(host)
+	}
+
+	msgId := "-"
+	if c.MsgIDFromProcId {
+		msgId = msgIdFromProcId(procId)
+	}
+
+	return "<134>1 " + ts + " " + host + " " +
+		c.Token + " " + procId + " " + msgId + " - "
+}
+
+// Take the Bundle of messages buffered so far, leaving an empty one
+// in its place.
+//
+// The Bundle belongs to the caller until it is handed back with
+// ReleaseBundle; typically it is submitted to Logplex with Post in
+// between.
+func (c *MiniClient) SwapBundle() *Bundle {
 	// Swap out the bundle for a fresh one, so that buffering can
 	// continue again immediately.  It's the caller's perogative
-	// to submit the Bundle to logplex.
+	// to submit the Bundle to logplex, and then to hand it back
+	// with ReleaseBundle.
+	newB := c.BundlePool.Get()
+
 	c.bSwapLock.Lock()
 	defer c.bSwapLock.Unlock()
 
-	var newB Bundle
-	var oldB Bundle
-
-	oldB = *c.b
-	c.b = &newB
+	oldB := c.b
+	c.b = newB
 
 	return oldB
 }
 
+// Recycle a Bundle returned by SwapBundle once it is no longer needed.
+// The Bundle must not be used after being released, but a post of it
+// still in progress keeps its storage from being re-used until done.
+func (c *MiniClient) ReleaseBundle(b *Bundle) {
+	c.BundlePool.Put(b)
+}
+
+// Close the idle keep-alive connections of the HTTP client, so that
+// the next post dials afresh.  This is useful after a network outage,
+// when idle connections may have gone stale.
+func (c *MiniClient) CloseIdleConnections() {
+	c.HttpClient.CloseIdleConnections()
+}
+
+// A post was answered with a status other than 204 No Content.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("logplexc: post failed with status %d",
+		e.StatusCode)
+}
+
+// Post the messages buffered so far and wait for the outcome.
+//
+// A transport error is returned as-is, and a reply other than 204 No
+// Content as a *StatusError.  Nothing is posted if nothing has been
+// buffered.
+func (c *MiniClient) Drain() error {
+	return c.drain(func(b *Bundle) error {
+		resp, err := c.Post(b)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			return &StatusError{StatusCode: resp.StatusCode}
+		}
+
+		return nil
+	})
+}
+
+// Swap out the messages buffered so far and hand them to post, if
+// there are any, releasing the Bundle afterwards.  This is Drain with
+// the posting left to the caller, which is how Client.Flush accrues
+// statistics on the outcome.
+func (c *MiniClient) drain(post func(b *Bundle) error) error {
+	b := c.SwapBundle()
+	defer c.ReleaseBundle(b)
+
+	if b.NumberFramed <= 0 {
+		return nil
+	}
+
+	return post(b)
+}
+
+// Submit a Bundle to Logplex.
+//
+// The Bundle is not modified, and the HTTP response is returned
+// uninspected: it is up to the caller to check its status and to
+// close its body.
+//
+// The Bundle may be handed back with ReleaseBundle as soon as Post
+// returns.  The post holds on to it until the HTTP transport is done
+// reading the request body, which may be after the response arrives,
+// and only then is it recycled.
 func (c *MiniClient) Post(b *Bundle) (*http.Response, error) {
+	return c.post(context.Background(), b)
+}
+
+func (c *MiniClient) post(
+	ctx context.Context, b *Bundle) (*http.Response, error) {
+	return c.postTo(ctx, c.Logplex, b)
+}
+
+// Submit a Bundle to a Logplex other than the MiniClient's own, with
+// the same HTTP client and headers.
+func (c *MiniClient) postTo(ctx context.Context, logplex url.URL,
+	b *Bundle) (*http.Response, error) {
 	// Record that a request is in progress so that a clean
 	// shutdown can wait for it to complete.
 	c.reqInFlight.Add(1)
 	defer c.reqInFlight.Done()
 
-	req, err := http.NewRequest("POST", c.Logplex.String(), &b.outbox)
+	req, err := http.NewRequest("POST", logplex.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Content-Type", "application/logplex-1")
-	req.Header.Add("Logplex-Msg-Count",
+	// The transport may go on reading the body after Do returns,
+	// as over HTTP/2, so the Bundle is only recycled once the
+	// body is closed.
+	if b.outbox.Len() > 0 {
+		req.Body = newBundleBody(b)
+		req.GetBody = func() (io.ReadCloser, error) {
+			return newBundleBody(b), nil
+		}
+		req.ContentLength = int64(b.outbox.Len())
+	}
+
+	req = req.WithContext(ctx)
+
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", "application/logplex-1")
+	req.Header.Set("Logplex-Msg-Count",
 		strconv.FormatUint(b.NumberFramed, 10))
 
+	if b.id != "" {
+		req.Header.Set("X-Bundle-ID", b.id)
+	}
+
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,400 @@
+package logplexc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testToken = "t.00000000-0000-0000-0000-000000000000"
+
+func newTestMiniClient(t *testing.T) *MiniClient {
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex: BogusLogplexUrl,
+		Token:   testToken,
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	return c
+}
+
+func TestBundlePoolRecycles(t *testing.T) {
+	bp := NewBundlePool(1024)
+
+	b := bp.Get()
+	if b.NumberFramed != 0 || b.outbox.Len() != 0 {
+		t.Fatalf("Fresh bundle is not empty: %+v", b.MiniStats)
+	}
+
+	b.outbox.WriteString("some framed bytes")
+	b.NumberFramed = 1
+	b.Buffered = b.outbox.Len()
+	bp.Put(b)
+
+	// sync.Pool makes no promise to hand back the same Bundle,
+	// but whatever comes back has to be empty.
+	b = bp.Get()
+	if b.NumberFramed != 0 || b.Buffered != 0 || b.outbox.Len() != 0 {
+		t.Fatalf("Recycled bundle is not empty: %+v", b.MiniStats)
+	}
+}
+
+func TestSwapBundleUsesPool(t *testing.T) {
+	c := newTestMiniClient(t)
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	b := c.SwapBundle()
+
+	if b.NumberFramed != 1 {
+		t.Fatalf("Expected one framed message, got %d", b.NumberFramed)
+	}
+
+	if !bytes.HasSuffix(b.outbox.Bytes(), []byte("hello")) {
+		t.Fatalf("Unexpected bundle contents: %q", b.outbox.Bytes())
+	}
+
+	if s := c.Statistics(); s.NumberFramed != 0 || s.Buffered != 0 {
+		t.Fatalf("Swapped-in bundle is not empty: %+v", s)
+	}
+
+	c.ReleaseBundle(b)
+}
+
+func TestNewMiniClientValidates(t *testing.T) {
+	noHost := BogusLogplexUrl
+	noHost.Host = ""
+
+	badScheme := BogusLogplexUrl
+	badScheme.Scheme = "ftp"
+
+	for _, cfg := range []MiniConfig{
+		{Logplex: BogusLogplexUrl},
+		{Logplex: noHost, Token: testToken},
+		{Logplex: badScheme, Token: testToken},
+	} {
+		if _, err := NewMiniClient(&cfg); err == nil {
+			t.Errorf("Expected an error for config %+v", cfg)
+		}
+	}
+}
+
+func TestPostLeavesBundleIntact(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex: ts.logplexUrl(t),
+		Token:   testToken,
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	b := c.SwapBundle()
+
+	want := append([]byte(nil), b.Bytes()...)
+	resp, err := c.Post(b)
+	if err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("Bundle modified by Post: %q", b.Bytes())
+	}
+
+	// The Bundle can be released once Post returns, and what was
+	// posted is unaffected by its storage being re-used.
+	c.ReleaseBundle(b)
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("again"))
+	c.ReleaseBundle(c.SwapBundle())
+
+	if !bytes.Equal(ts.body(0), want) {
+		t.Fatalf("Posted %q, expected %q", ts.body(0), want)
+	}
+}
+
+// An http.RoundTripper that answers at once, and reads and closes the
+// request body only later, as the HTTP/2 transport may.
+type lateBodyTransport struct {
+	read chan struct{}
+	body chan []byte
+}
+
+func (lt *lateBodyTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	go func() {
+		<-lt.read
+		b, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		lt.body <- b
+	}()
+
+	return &http.Response{
+		StatusCode: http.StatusNoContent,
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+func TestReleaseBundleWhileBodyOpen(t *testing.T) {
+	lt := &lateBodyTransport{
+		read: make(chan struct{}),
+		body: make(chan []byte, 1),
+	}
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex:    BogusLogplexUrl,
+		Token:      testToken,
+		HttpClient: http.Client{Transport: lt},
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	b := c.SwapBundle()
+	want := append([]byte(nil), b.Bytes()...)
+
+	resp, err := c.Post(b)
+	if err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	resp.Body.Close()
+	c.ReleaseBundle(b)
+
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("Bundle recycled with its body still open: %q",
+			b.Bytes())
+	}
+
+	close(lt.read)
+	if got := <-lt.body; !bytes.Equal(got, want) {
+		t.Fatalf("Posted %q, expected %q", got, want)
+	}
+
+	if b.NumberFramed != 0 || b.outbox.Len() != 0 {
+		t.Fatalf("Bundle not recycled once its body was closed: %q",
+			b.Bytes())
+	}
+}
+
+func TestHostEncoding(t *testing.T) {
+	if h := NormalizeHost("hôte"); h != "h?te" {
+		t.Fatalf("Unexpected normalized host %q", h)
+	}
+
+	if h := NormalizeHost("host-1.example.com"); h != "host-1.example.com" {
+		t.Fatalf("ASCII host altered to %q", h)
+	}
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex:            BogusLogplexUrl,
+		Token:              testToken,
+		EncodeHostAsBase64: true,
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	c.BufferMessage(time.Now(), "hôte", "web.1", []byte("hello"))
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	b := c.SwapBundle()
+
+	if !bytes.Contains(b.Bytes(), []byte(" aMO0dGU= "+testToken+" ")) {
+		t.Fatalf("Expected base64 encoded host in %q", b.Bytes())
+	}
+
+	if !bytes.Contains(b.Bytes(), []byte(" host "+testToken+" ")) {
+		t.Fatalf("Expected ASCII host left alone in %q", b.Bytes())
+	}
+}
+
+func TestMsgIdFromProcId(t *testing.T) {
+	for procId, want := range map[string]string{
+		"web.1":        "web",
+		"worker/2":     "worker",
+		"clock":        "clock",
+		".1":           "-",
+		"":             "-",
+		"spaced out.1": "-",
+	} {
+		if got := msgIdFromProcId(procId); got != want {
+			t.Errorf("msgIdFromProcId(%q) = %q, expected %q",
+				procId, got, want)
+		}
+	}
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex:         BogusLogplexUrl,
+		Token:           testToken,
+		MsgIDFromProcId: true,
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	b := c.SwapBundle()
+
+	if !bytes.HasSuffix(b.Bytes(), []byte(" web.1 web - hello")) {
+		t.Fatalf("Expected MSGID in %q", b.Bytes())
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex: ts.logplexUrl(t),
+		Token:   testToken,
+	})
+	if err != nil {
+		t.Fatalf("Could not create MiniClient: %v", err)
+	}
+
+	// Nothing buffered, nothing posted.
+	if err := c.Drain(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if n := ts.requestCount(); n != 0 {
+		t.Fatalf("Expected no requests, got %d", n)
+	}
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	if err := c.Drain(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if n := ts.messageCount(); n != 1 {
+		t.Fatalf("Expected one message, got %d", n)
+	}
+
+	ts.setStatus(http.StatusForbidden)
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("hello"))
+	err = c.Drain()
+	if se, ok := err.(*StatusError); !ok ||
+		se.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a 403 *StatusError, got %v", err)
+	}
+}
+
+func TestRebufferTracksAttempts(t *testing.T) {
+	c := newTestMiniClient(t)
+
+	for _, log := range []string{"a", "b", "c"} {
+		c.BufferMessage(time.Now(), "host", "web.1", []byte(log))
+	}
+
+	failed := c.SwapBundle()
+	moved := c.rebuffer(failed, func(int) bool { return true })
+	if moved.NumberFramed != 3 || moved.Buffered != failed.Buffered {
+		t.Fatalf("Expected all of %+v buffered again, got %+v",
+			failed.MiniStats, moved)
+	}
+	c.ReleaseBundle(failed)
+
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("d"))
+
+	// Filtering must keep the attempts of the remaining messages.
+	b := c.SwapBundle()
+	b.filter(func(msg []byte) bool {
+		return !bytes.HasSuffix(msg, []byte("b"))
+	})
+
+	if len(b.attempts) != 3 || b.attempts[0] != 1 ||
+		b.attempts[1] != 1 || b.attempts[2] != 0 {
+		t.Fatalf("Unexpected attempts %v", b.attempts)
+	}
+}
+
+func TestTrimOldest(t *testing.T) {
+	c := newTestMiniClient(t)
+
+	for _, log := range []string{"a", "b", "c"} {
+		c.BufferMessage(time.Now(), "host", "web.1", []byte(log))
+	}
+
+	before := c.Statistics()
+	removed := c.TrimOldest(2)
+	after := c.Statistics()
+
+	if removed.NumberFramed != 2 || after.NumberFramed != 1 ||
+		removed.Buffered+after.Buffered != before.Buffered {
+		t.Fatalf("Unexpected trim of %+v: removed %+v, left %+v",
+			before, removed, after)
+	}
+
+	b := c.SwapBundle()
+	if !bytes.HasSuffix(b.Bytes(), []byte("c")) || len(b.attempts) != 1 {
+		t.Fatalf("Expected only the newest message, got %q", b.Bytes())
+	}
+
+	// Trimming more than there is empties the bundle.
+	c.BufferMessage(time.Now(), "host", "web.1", []byte("d"))
+	if removed := c.TrimOldest(5); removed.NumberFramed != 1 {
+		t.Fatalf("Expected one message removed, got %+v", removed)
+	}
+}
+
+func TestReplayBundle(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	c := newTestMiniClient(t)
+	for _, log := range []string{"first", "second"} {
+		c.BufferMessage(time.Now(), "host", "web.1", []byte(log))
+	}
+
+	b := c.SwapBundle()
+	path := filepath.Join(t.TempDir(), "bundle")
+	if err := b.Save(path); err != nil {
+		t.Fatalf("Could not save bundle: %v", err)
+	}
+
+	cfg := ts.config(t)
+	if err := ReplayBundle(path, &cfg); err != nil {
+		t.Fatalf("Could not replay bundle: %v", err)
+	}
+
+	if !bytes.Equal(ts.body(0), b.Bytes()) {
+		t.Fatalf("Replayed %q, expected %q", ts.body(0), b.Bytes())
+	}
+
+	if n := ts.messageCount(); n != 2 {
+		t.Fatalf("Expected 2 messages counted, got %d", n)
+	}
+
+	ts.setStatus(http.StatusBadRequest)
+	err := ReplayBundle(path, &cfg)
+	if se, ok := err.(*StatusError); !ok ||
+		se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 *StatusError, got %v", err)
+	}
+
+	// Anything but a saved Bundle is refused.
+	if err := os.WriteFile(path, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReplayBundle(path, &cfg); err == nil {
+		t.Fatal("Expected an error replaying junk")
+	}
+
+	if n := ts.requestCount(); n != 2 {
+		t.Fatalf("Expected 2 requests, got %d", n)
+	}
+}
@@ -0,0 +1,108 @@
+package logplexc
+
+import (
+	"sync/atomic"
+)
+
+// A bundle's place in line behind the bundles buffered before it that
+// share a procId with it, when Config.OrderByProcId is set.
+type postOrder struct {
+	// The done channels of the bundles to wait for.
+	after []chan struct{}
+
+	// Closed once this bundle has been posted, or given up on.
+	done chan struct{}
+
+	procIds []string
+}
+
+// Wait for the bundles ahead in line to be done.  A nil postOrder
+// waits for nothing.
+func (o *postOrder) wait() {
+	if o == nil {
+		return
+	}
+
+	for _, c := range o.after {
+		<-c
+	}
+}
+
+// Wait for the bundles ahead of this one in line, counting it as
+// queued for as long as there are any.
+func (m *Client) waitOrdered(o *postOrder) {
+	if o == nil || len(o.after) == 0 {
+		return
+	}
+
+	atomic.AddInt32(&m.queuedBundles, 1)
+	defer atomic.AddInt32(&m.queuedBundles, -1)
+
+	o.wait()
+}
+
+// Put a bundle that is about to be posted in line, if posts are
+// ordered by procId.
+//
+// Bundles have to take their places in line in the same order that
+// they are swapped out, so the caller must hold orderLock from before
+// swapping until after this returns.  Bundles that are not going to
+// be posted must not be put in line, as the bundles behind them
+// would lose track of the ones ahead.
+func (m *Client) enqueueOrdered(b *Bundle) *postOrder {
+	if !m.orderByProcId {
+		return nil
+	}
+
+	o := postOrder{done: make(chan struct{})}
+
+	seen := make(map[string]bool)
+	b.each(func(msg []byte) {
+		procId := syslogProcId(msg)
+		if !seen[procId] {
+			seen[procId] = true
+			o.procIds = append(o.procIds, procId)
+		}
+	})
+
+	for _, procId := range o.procIds {
+		if prev, ok := m.procIdTails[procId]; ok {
+			o.after = append(o.after, prev)
+		}
+
+		m.procIdTails[procId] = o.done
+	}
+
+	return &o
+}
+
+// Lock orderLock, if posts are ordered by procId.
+func (m *Client) lockOrder() {
+	if m.orderByProcId {
+		m.orderLock.Lock()
+	}
+}
+
+func (m *Client) unlockOrder() {
+	if m.orderByProcId {
+		m.orderLock.Unlock()
+	}
+}
+
+// Let the bundles behind this one in line proceed.
+func (m *Client) finishOrdered(o *postOrder) {
+	if o == nil {
+		return
+	}
+
+	m.orderLock.Lock()
+	defer m.orderLock.Unlock()
+
+	for _, procId := range o.procIds {
+		if m.procIdTails[procId] == o.done {
+			delete(m.procIdTails, procId)
+		}
+	}
+
+	close(o.done)
+}
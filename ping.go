@@ -0,0 +1,61 @@
+package logplexc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// The procId of the synthetic message sent by Ping, so that operators
+// can filter it out.
+const PingProcId = "logplexc-ping"
+
+// How much of a rejecting response's body a PingError retains.
+const maxPingErrorBody = 512
+
+// Ping received a response other than 204 No Content.
+type PingError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *PingError) Error() string {
+	return fmt.Sprintf("logplexc.Client: ping failed with status %d: %q",
+		e.StatusCode, e.Body)
+}
+
+// Check that Logplex is reachable and accepts this Client's
+// credentials by posting a single synthetic message, with procId
+// PingProcId, and waiting for the reply.
+//
+// A transport error is returned as-is, and a reply other than 204 No
+// Content as a *PingError.  Statistics are not affected.
+func (m *Client) Ping(ctx context.Context) error {
+	if m.closed() {
+		return ErrClientClosed
+	}
+
+	b := m.c.BundlePool.Get()
+	defer m.c.ReleaseBundle(b)
+
+	prefix := m.c.syslogPrefix(time.Now(), "localhost", PingProcId)
+	log := []byte("ping")
+	frame(b, len(prefix)+len(log), prefix, log)
+
+	resp, err := m.c.post(ctx, b)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(
+			io.LimitReader(resp.Body, maxPingErrorBody))
+		return &PingError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return nil
+}
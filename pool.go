@@ -0,0 +1,122 @@
+package logplexc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// A free list of Bundles.
+//
+// Every flush of a MiniClient swaps in a fresh Bundle, and in a busy
+// program that amounts to allocating -- and then garbage collecting
+// -- a request-sized buffer for each POST.  A BundlePool lets those
+// buffers be recycled between flush cycles instead.
+//
+// A BundlePool is safe for concurrent use, and may be shared between
+// MiniClients.
+type BundlePool struct {
+	p sync.Pool
+}
+
+// Create a BundlePool whose new Bundles have room for initialCapacity
+// bytes of framed messages before needing to grow.
+func NewBundlePool(initialCapacity int) *BundlePool {
+	if initialCapacity < 0 {
+		initialCapacity = 0
+	}
+
+	bp := BundlePool{}
+	bp.p.New = func() interface{} {
+		b := Bundle{}
+		b.outbox.Grow(initialCapacity)
+		return &b
+	}
+
+	return &bp
+}
+
+// Get an empty Bundle, either recycled or freshly allocated.
+func (bp *BundlePool) Get() *Bundle {
+	return bp.p.Get().(*Bundle)
+}
+
+// Return a Bundle to the pool for re-use.
+//
+// The Bundle is emptied, and must not be used by the caller after
+// being Put.  A Bundle still being read by the body of a post is only
+// emptied and recycled once the HTTP transport closes that body.
+func (bp *BundlePool) Put(b *Bundle) {
+	if b == nil {
+		return
+	}
+
+	b.pool = bp
+	if atomic.AddInt32(&b.holds, -1) >= 0 {
+		return
+	}
+
+	bp.recycle(b)
+}
+
+func (bp *BundlePool) recycle(b *Bundle) {
+	b.MiniStats = MiniStats{}
+	b.outbox.Reset()
+	b.attempts = b.attempts[:0]
+	b.id = ""
+	b.holds = 0
+	b.pool = nil
+	bp.p.Put(b)
+}
+
+// The body of a post of a Bundle, which holds the Bundle back from
+// being recycled until it is closed.
+//
+// Reads after Close find the body empty, so that a transport still
+// reading when it closes the body cannot see the Bundle's storage
+// being re-used.
+type bundleBody struct {
+	mu     sync.Mutex
+	r      bytes.Reader
+	b      *Bundle
+	closed bool
+}
+
+func newBundleBody(b *Bundle) *bundleBody {
+	atomic.AddInt32(&b.holds, 1)
+
+	bb := bundleBody{b: b}
+	bb.r.Reset(b.Bytes())
+
+	return &bb
+}
+
+func (bb *bundleBody) Read(p []byte) (int, error) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+
+	if bb.closed {
+		return 0, io.EOF
+	}
+
+	return bb.r.Read(p)
+}
+
+func (bb *bundleBody) Close() error {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+
+	if bb.closed {
+		return nil
+	}
+
+	bb.closed = true
+	bb.r.Reset(nil)
+
+	if atomic.AddInt32(&bb.b.holds, -1) < 0 {
+		bb.b.pool.recycle(bb.b)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package logplexc
+
+import "sync/atomic"
+
+// Whether Config.MaxQueuedBundles bundles are already being posted.
+func (m *Client) queueFull() bool {
+	return m.maxQueuedBundles > 0 &&
+		atomic.LoadInt32(&m.pendingBundles) >= m.maxQueuedBundles
+}
+
+// Drop what has been buffered per Config.DropPolicy, without looking
+// for a worker to post it, for the queue being full.
+func (m *Client) dropBuffered() {
+	if m.dropPolicy == DropPolicyDropOldest {
+		m.dropOldest()
+		return
+	}
+
+	b := m.c.SwapBundle()
+	if b.NumberFramed <= 0 {
+		m.c.ReleaseBundle(b)
+		return
+	}
+
+	m.rateWindow.countBundle()
+	m.dropBundle(b)
+}
@@ -0,0 +1,64 @@
+package logplexc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The Clients registered with Register, by name.
+var registry sync.Map
+
+// Make a Client known by name to the rest of the program, e.g. for
+// monitoring all of a program's Clients through All.  A name can only
+// be registered once at a time; Closing a Client unregisters it from
+// all the names it was registered as.
+func Register(name string, c *Client) error {
+	if c == nil {
+		return errors.New("logplexc: cannot register a nil Client")
+	}
+
+	if _, loaded := registry.LoadOrStore(name, c); loaded {
+		return fmt.Errorf("logplexc: a Client is already registered "+
+			"as %q", name)
+	}
+
+	return nil
+}
+
+// The Client registered as name, if any.
+func Lookup(name string) (*Client, bool) {
+	c, ok := registry.Load(name)
+	if !ok {
+		return nil, false
+	}
+
+	return c.(*Client), true
+}
+
+// A copy of the registry, by name.
+func All() map[string]*Client {
+	all := make(map[string]*Client)
+	registry.Range(func(name, c interface{}) bool {
+		all[name.(string)] = c.(*Client)
+		return true
+	})
+
+	return all
+}
+
+// Forget the Client registered as name, if any.
+func Unregister(name string) {
+	registry.Delete(name)
+}
+
+// Forget every name the Client is registered as.
+func (m *Client) unregisterAll() {
+	registry.Range(func(name, c interface{}) bool {
+		if c == m {
+			registry.CompareAndDelete(name, m)
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,109 @@
+package logplexc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Write the framed messages of the Bundle to a file at path, to be
+// posted again later by ReplayBundle.
+//
+// The file holds the length of the messages, as an eight-byte
+// big-endian integer, followed by the messages exactly as they are
+// posted to Logplex.
+func (b *Bundle) Save(path string) error {
+	data := b.outbox.Bytes()
+	blob := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(blob, uint64(len(data)))
+	blob = append(blob, data...)
+
+	return os.WriteFile(path, blob, 0600)
+}
+
+// Read a Bundle written by Bundle.Save.
+func loadBundle(path string) (*Bundle, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < 8 ||
+		binary.BigEndian.Uint64(blob) != uint64(len(blob)-8) {
+		return nil, fmt.Errorf("logplexc: %s is not a saved Bundle",
+			path)
+	}
+
+	b := &Bundle{}
+	rest := blob[8:]
+	for len(rest) > 0 {
+		whole, _, next, err := nextFrame(rest)
+		if err != nil {
+			return nil, fmt.Errorf("logplexc: %s has a malformed "+
+				"message", path)
+		}
+
+		b.begin()
+		b.outbox.Write(whole)
+		b.NumberFramed += 1
+		b.attempts = append(b.attempts, 0)
+		rest = next
+	}
+
+	b.Buffered = b.outbox.Len()
+
+	return b, nil
+}
+
+// Post a Bundle saved by Bundle.Save to the Logplex of cfg, once,
+// and print the status of the response to os.Stderr.  This is for
+// debugging, such as replaying a rejected Bundle against a staging
+// Logplex: the messages are posted exactly as they were framed, with
+// the token they were framed with.
+//
+// Returns a *StatusError if Logplex responds with anything but 204
+// No Content.
+func ReplayBundle(path string, cfg *Config) error {
+	b, err := loadBundle(path)
+	if err != nil {
+		return err
+	}
+
+	if b.NumberFramed == 0 {
+		return errors.New("logplexc: saved Bundle has no messages")
+	}
+
+	httpClient, err := configureHttpClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	c, err := NewMiniClient(&MiniConfig{
+		Logplex:         cfg.Logplex,
+		Token:           cfg.Token,
+		HttpClient:      httpClient,
+		RequestMetadata: cfg.RequestMetadata,
+		CustomHeaders:   cfg.CustomHeaders,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Post(b)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	fmt.Fprintf(os.Stderr, "logplexc: replayed %d messages from %s: %s\n",
+		b.NumberFramed, path, resp.Status)
+
+	if resp.StatusCode != http.StatusNoContent {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package logplexc
+
+import "time"
+
+// Concurrency is sampled every concurrencySampleInterval, and the
+// samples from the last concurrencySampleWindow are kept for
+// computing Stats.ConcurrencyP95.
+const (
+	concurrencySampleInterval = 100 * time.Millisecond
+	concurrencySampleWindow   = 5 * time.Minute
+	concurrencySampleCount    = int(concurrencySampleWindow /
+		concurrencySampleInterval)
+)
+
+// A sliding window of samples of concurrency, oldest overwritten
+// first, with a histogram of how many samples in the window have
+// each level, so that percentiles need no sorting.
+type concurrencySamples struct {
+	samples [concurrencySampleCount]int32
+	n       int
+	next    int
+
+	// counts[v] is the number of samples of level v.
+	counts []int
+}
+
+func (cs *concurrencySamples) add(v int32) {
+	if v < 0 {
+		v = 0
+	}
+
+	if cs.n == len(cs.samples) {
+		cs.counts[cs.samples[cs.next]] -= 1
+	} else {
+		cs.n += 1
+	}
+
+	for int(v) >= len(cs.counts) {
+		cs.counts = append(cs.counts, 0)
+	}
+
+	cs.counts[v] += 1
+	cs.samples[cs.next] = v
+	cs.next = (cs.next + 1) % len(cs.samples)
+}
+
+// The nearest-rank percentile of the samples in the window, with p
+// in (0, 1].  Zero when there are no samples yet.
+func (cs *concurrencySamples) percentile(p float64) int32 {
+	if cs.n == 0 {
+		return 0
+	}
+
+	rank := int(p*float64(cs.n)+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= cs.n {
+		rank = cs.n - 1
+	}
+
+	seen := 0
+	for v, count := range cs.counts {
+		seen += count
+		if seen > rank {
+			return int32(v)
+		}
+	}
+
+	return int32(len(cs.counts) - 1)
+}
+
+// Sample the concurrency until the Client is closed.
+func (m *Client) sampleConcurrency() {
+	defer func() { m.finalizeDone.Done() }()
+
+	t := time.NewTicker(concurrencySampleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-m.finalize:
+			return
+		}
+
+		m.statConcurrencySample(m.currentConcurrency())
+	}
+}
+
+func (m *Client) statConcurrencySample(v int32) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.concurrencySamples.add(v)
+}
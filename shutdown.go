@@ -0,0 +1,59 @@
+package logplexc
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Close the Client once any of sigs is received, per
+// Config.FlushOnShutdownSignal, then deliver the signal again to let
+// it take its course.  The signals are intercepted from the time this
+// returns.
+func (m *Client) closeOnSignal(sigs []os.Signal, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go m.awaitSignal(ch, timeout)
+}
+
+func (m *Client) awaitSignal(ch chan os.Signal, timeout time.Duration) {
+	var sig os.Signal
+	select {
+	case sig = <-ch:
+	case <-m.finalize:
+		signal.Stop(ch)
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		if err := m.GracefulClose(); err != nil {
+			log.Printf("logplexc.Client: could not flush on %v: %v",
+				sig, err)
+		}
+
+		close(closed)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	select {
+	case <-closed:
+	case <-deadline:
+		log.Printf("logplexc.Client: gave up flushing on %v "+
+			"after %v", sig, timeout)
+	}
+
+	// Stop intercepting the signal, so that, unless the program
+	// handles it too, it has its usual effect.
+	signal.Stop(ch)
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(sig)
+	}
+}
@@ -0,0 +1,87 @@
+package logplexc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Diagnostics of the Client's own workings, written to
+// Config.SlogLogger.  Each does nothing, and allocates nothing, when
+// there is no logger.
+
+func (m *Client) logPost(b *Bundle) {
+	if m.slog == nil {
+		return
+	}
+
+	m.slog.LogAttrs(context.Background(), slog.LevelDebug,
+		"logplexc: posting bundle",
+		slog.String("endpoint", m.slogEndpoint),
+		slog.Uint64("bundle_messages", b.NumberFramed),
+		slog.Int("bundle_bytes", b.Buffered))
+}
+
+func (m *Client) logPostFailed(b *Bundle, err error) {
+	if m.slog == nil {
+		return
+	}
+
+	m.slog.LogAttrs(context.Background(), slog.LevelWarn,
+		"logplexc: post failed",
+		slog.String("error", err.Error()),
+		slog.Uint64("bundle_messages", b.NumberFramed))
+}
+
+func (m *Client) logRejected(b *Bundle, statusCode int) {
+	if m.slog == nil {
+		return
+	}
+
+	m.slog.LogAttrs(context.Background(), slog.LevelWarn,
+		"logplexc: post rejected",
+		slog.Int("status_code", statusCode),
+		slog.Uint64("bundle_messages", b.NumberFramed))
+}
+
+// Logged when Config.MaxConsecutiveErrors posts have failed in a row,
+// and the Client drops its connections to pause for delay.
+func (m *Client) logReconnect(failures int32, delay time.Duration) {
+	if m.slog == nil {
+		return
+	}
+
+	m.slog.LogAttrs(context.Background(), slog.LevelWarn,
+		"logplexc: reconnecting after consecutive failures",
+		slog.Int("consecutive_errors", int(failures)),
+		slog.Duration("delay", delay))
+}
+
+func (m *Client) logClosed(final Stats) {
+	if m.slog == nil {
+		return
+	}
+
+	m.slog.LogAttrs(context.Background(), slog.LevelInfo,
+		"logplexc: closed", slog.Any("stats", final))
+}
+
+// Render the Stats as a group of the counts String summarizes, when
+// logged with log/slog.
+func (s Stats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("total", s.Total),
+		slog.Uint64("successful", s.Successful),
+		slog.Uint64("dropped", s.Dropped),
+		slog.Uint64("cancelled", s.Cancelled),
+		slog.Uint64("rejected", s.Rejected),
+		slog.Uint64("total_posts", s.TotalPosts),
+		slog.Uint64("success_requests", s.SuccessRequests))
+}
+
+// Render the Client's Statistics, as Stats.LogValue does.  This
+// shadows Stats.LogValue, which would otherwise be promoted from the
+// Client's embedded Stats and read its counters without statLock.
+func (m *Client) LogValue() slog.Value {
+	return m.Statistics().LogValue()
+}
@@ -0,0 +1,240 @@
+package logplexc
+
+import (
+	"container/heap"
+	"sync"
+)
+
+const (
+	// Number of sources whose volume is tracked at once.
+	maxTrackedSources = 1000
+
+	// Number of sources reported by Stats.TopSources.
+	numTopSources = 10
+)
+
+// The volume of messages buffered from one host and procId.
+type SourceStat struct {
+	Host         string
+	ProcId       string
+	MessageCount uint64
+	ByteCount    uint64
+}
+
+type sourceKey struct {
+	host   string
+	procId string
+}
+
+// A tracked source, its place among the top sources, or -1 if it is
+// not among them, and its place in the tracker's heap.
+type trackedSource struct {
+	SourceStat
+	rank  int
+	index int
+}
+
+// Counts the messages buffered from each host and procId, for
+// finding the noisiest.
+//
+// Up to maxEntries sources are tracked; to make room for another, the
+// one that ranks lowest is forgotten.  The sources are kept in a heap
+// with the lowest ranked at its root, so that finding it costs no
+// more than keeping the heap in order as counts go up.
+//
+// The numTopSources sources with the most messages are kept in order
+// as they are counted, which costs little, since counts only ever
+// go up.  The source forgotten is only among them when every source
+// is, so it never needs replacing.
+//
+// A nil sourceTracker counts nothing and has no top sources.
+type sourceTracker struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	sources map[sourceKey]*trackedSource
+	heap    sourceHeap
+	ranked  [numTopSources]*trackedSource
+	numTop  int
+}
+
+func newSourceTracker(maxEntries int) *sourceTracker {
+	return &sourceTracker{
+		maxEntries: maxEntries,
+		sources:    make(map[sourceKey]*trackedSource),
+	}
+}
+
+// Count a message of n bytes from host and procId.
+func (st *sourceTracker) count(host string, procId string, n int) {
+	if st == nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.countUnsync(host, procId, n)
+}
+
+// Count every one of the entries, taking the lock only once.
+func (st *sourceTracker) countAll(entries []LogEntry) {
+	if st == nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for i := range entries {
+		st.countUnsync(entries[i].Host, entries[i].ProcId,
+			len(entries[i].Log))
+	}
+}
+
+func (st *sourceTracker) countUnsync(host string, procId string, n int) {
+	k := sourceKey{host: host, procId: procId}
+
+	s, ok := st.sources[k]
+	if !ok {
+		if len(st.sources) >= st.maxEntries {
+			st.evictUnsync()
+		}
+
+		s = &trackedSource{
+			SourceStat: SourceStat{Host: host, ProcId: procId},
+			rank:       -1,
+		}
+		st.sources[k] = s
+		heap.Push(&st.heap, s)
+	}
+
+	s.MessageCount += 1
+	s.ByteCount += uint64(n)
+	heap.Fix(&st.heap, s.index)
+	st.rankUnsync(s)
+}
+
+// Move s up among the top sources as far as its count now takes it,
+// bringing it in should it have overtaken the last of them.
+func (st *sourceTracker) rankUnsync(s *trackedSource) {
+	if s.rank < 0 {
+		if st.numTop < len(st.ranked) {
+			st.numTop += 1
+		} else if moreMessages(&s.SourceStat,
+			&st.ranked[st.numTop-1].SourceStat) {
+			st.ranked[st.numTop-1].rank = -1
+		} else {
+			return
+		}
+
+		s.rank = st.numTop - 1
+		st.ranked[s.rank] = s
+	}
+
+	for i := s.rank; i > 0 && moreMessages(&s.SourceStat,
+		&st.ranked[i-1].SourceStat); i -= 1 {
+		st.ranked[i] = st.ranked[i-1]
+		st.ranked[i].rank = i
+		st.ranked[i-1] = s
+		s.rank = i - 1
+	}
+}
+
+// Forget the source that ranks lowest.
+func (st *sourceTracker) evictUnsync() {
+	if len(st.heap) == 0 {
+		return
+	}
+
+	least := heap.Pop(&st.heap).(*trackedSource)
+	delete(st.sources, sourceKey{least.Host, least.ProcId})
+
+	if least.rank >= 0 {
+		// Ranking below every other source, it can only
+		// be the last of the top.
+		st.numTop -= 1
+		st.ranked[st.numTop] = nil
+	}
+}
+
+// A min-heap of tracked sources, by moreMessages.
+type sourceHeap []*trackedSource
+
+func (h sourceHeap) Len() int { return len(h) }
+
+func (h sourceHeap) Less(i, j int) bool {
+	return moreMessages(&h[j].SourceStat, &h[i].SourceStat)
+}
+
+func (h sourceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sourceHeap) Push(x interface{}) {
+	s := x.(*trackedSource)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return s
+}
+
+// Copy the sources with the most messages into top, most first,
+// returning how many were copied.
+func (st *sourceTracker) top(top *[numTopSources]SourceStat) int {
+	if st == nil {
+		return 0
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for i := 0; i < st.numTop; i += 1 {
+		top[i] = st.ranked[i].SourceStat
+	}
+
+	return st.numTop
+}
+
+// Whether a ranks above b, breaking ties the same way every time.
+func moreMessages(a, b *SourceStat) bool {
+	if a.MessageCount != b.MessageCount {
+		return a.MessageCount > b.MessageCount
+	}
+
+	if a.Host != b.Host {
+		return a.Host < b.Host
+	}
+
+	return a.ProcId < b.ProcId
+}
+
+// The sources that the most messages were buffered from, most first,
+// up to ten of them, as of retrieval of the Stats.  Sources are only
+// tracked with Config.TrackSources; otherwise there are none.
+//
+// Only the busiest thousand sources are tracked at any time, so a
+// source that has been forgotten to make room for others may be
+// under-counted should it become busy again.
+func (s Stats) TopSources() []SourceStat {
+	return append([]SourceStat(nil), s.topSources[:s.numTopSources]...)
+}
+
+// The sources that the most messages have been buffered from so far,
+// as Stats.TopSources has them.
+//
+// This shadows Stats.TopSources, which would otherwise be promoted
+// from the Client's embedded Stats, where it is never filled in.
+func (m *Client) TopSources() []SourceStat {
+	var top [numTopSources]SourceStat
+	n := m.sources.top(&top)
+	return append([]SourceStat(nil), top[:n]...)
+}
@@ -0,0 +1,55 @@
+package logplexc
+
+// Get a channel that receives a snapshot of the Client's Statistics
+// each time a post to Logplex completes, whatever its outcome.
+//
+// Snapshots are never waited on: when the channel's buffer of
+// bufsize is full, the snapshot is not sent.  The channel is closed
+// once the Client has Closed.  Each call returns a channel of its
+// own.
+func (m *Client) StatsChan(bufsize int) <-chan Stats {
+	ch := make(chan Stats, bufsize)
+
+	m.statsChansLock.Lock()
+	defer m.statsChansLock.Unlock()
+
+	if m.statsChansClosed {
+		close(ch)
+		return ch
+	}
+
+	m.statsChans = append(m.statsChans, ch)
+	return ch
+}
+
+// Send a snapshot of the Statistics to every StatsChan with room for
+// it.
+func (m *Client) publishStats() {
+	m.statsChansLock.Lock()
+	defer m.statsChansLock.Unlock()
+
+	if len(m.statsChans) == 0 {
+		return
+	}
+
+	s := m.Statistics()
+	for _, ch := range m.statsChans {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
+// Close every StatsChan, once nothing more can be posted.
+func (m *Client) closeStatsChans() {
+	m.statsChansLock.Lock()
+	defer m.statsChansLock.Unlock()
+
+	for _, ch := range m.statsChans {
+		close(ch)
+	}
+
+	m.statsChans = nil
+	m.statsChansClosed = true
+}
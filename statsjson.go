@@ -0,0 +1,115 @@
+package logplexc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A one-line summary of the Stats, for logging.
+func (s Stats) String() string {
+	return fmt.Sprintf("total=%d ok=%d dropped=%d cancelled=%d "+
+		"rejected=%d concurrency=%d", s.Total, s.Successful,
+		s.Dropped, s.Cancelled, s.Rejected, s.Concurrency)
+}
+
+// Stats with the keys its fields have in JSON.  Having the same
+// fields as Stats, it can be converted to and from it, which keeps
+// the two from drifting apart.
+type statsJSON struct {
+	Concurrency             int32   `json:"concurrency"`
+	ConcurrencyP95          int32   `json:"concurrencyP95"`
+	BundleQueueDepth        int     `json:"bundleQueueDepth"`
+	QueueDepth              int32   `json:"queueDepth"`
+	CurrentBundleID         string  `json:"currentBundleId"`
+	Total                   uint64  `json:"total"`
+	Dropped                 uint64  `json:"dropped"`
+	Cancelled               uint64  `json:"cancelled"`
+	Rejected                uint64  `json:"rejected"`
+	Successful              uint64  `json:"successful"`
+	SuccessAfterRetry       uint64  `json:"successAfterRetry"`
+	Filtered                uint64  `json:"filtered"`
+	AgeDropped              uint64  `json:"ageDropped"`
+	Deduped                 uint64  `json:"deduped"`
+	Recovered               uint64  `json:"recovered"`
+	EscapedMessages         uint64  `json:"escapedMessages"`
+	FallbackSkipped         uint64  `json:"fallbackSkipped"`
+	TotalPosts              uint64  `json:"totalPosts"`
+	TotalRequests           uint64  `json:"totalRequests"`
+	DroppedRequests         uint64  `json:"droppedRequests"`
+	CancelRequests          uint64  `json:"cancelRequests"`
+	RejectRequests          uint64  `json:"rejectRequests"`
+	SuccessRequests         uint64  `json:"successRequests"`
+	NetworkErrors           uint64  `json:"networkErrors"`
+	TimeoutErrors           uint64  `json:"timeoutErrors"`
+	AuthErrors              uint64  `json:"authErrors"`
+	ClientErrors            uint64  `json:"clientErrors"`
+	ServerErrors            uint64  `json:"serverErrors"`
+	CumulativeSuccessBytes  uint64  `json:"cumulativeSuccessBytes"`
+	CumulativeDropBytes     uint64  `json:"cumulativeDropBytes"`
+	HTTP2Requests           uint64  `json:"http2Requests"`
+	FanoutFailedRequests    uint64  `json:"fanoutFailedRequests"`
+	RecentMessagesPerSecond float64 `json:"recentMessagesPerSecond"`
+	RecentBundlesPerSecond  float64 `json:"recentBundlesPerSecond"`
+	MeanSuccessLatencyMs    float64 `json:"meanSuccessLatencyMs"`
+	AvgTTFBMillis           float64 `json:"avgTtfbMillis"`
+	ErrorBudget             float64 `json:"errorBudget"`
+	SLOViolated             bool    `json:"sloViolated"`
+
+	// For TopSources, which is not encoded.
+	topSources    [numTopSources]SourceStat
+	numTopSources int
+}
+
+// Encode the Stats as a JSON object whose keys are the names of its
+// fields in camelCase, e.g. "totalPosts".
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statsJSON(s))
+}
+
+// Decode the Stats from JSON as MarshalJSON encodes them.
+func (s *Stats) UnmarshalJSON(data []byte) error {
+	var j statsJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	*s = Stats(j)
+	return nil
+}
+
+// Format the Stats as String has them, except for %+v and %#v, which
+// print every field, as they would for any other struct.
+func (s Stats) Format(f fmt.State, verb rune) {
+	if verb == 'v' && (f.Flag('+') || f.Flag('#')) {
+		fmt.Fprintf(f, fmt.FormatString(f, verb), statsFields(s))
+		return
+	}
+
+	fmt.Fprintf(f, fmt.FormatString(f, verb), s.String())
+}
+
+// The methods of Stats would otherwise be promoted from the Client's
+// embedded Stats, reading and writing its counters without statLock.
+// These go through Statistics instead.
+
+// A one-line summary of the Client's Statistics.
+func (m *Client) String() string {
+	return m.Statistics().String()
+}
+
+// Format the Client's Statistics, as Stats.Format does.
+func (m *Client) Format(f fmt.State, verb rune) {
+	m.Statistics().Format(f, verb)
+}
+
+// Encode the Client's Statistics, as Stats.MarshalJSON does.
+func (m *Client) MarshalJSON() ([]byte, error) {
+	return m.Statistics().MarshalJSON()
+}
+
+// A Client cannot be decoded from JSON; decode its Stats instead.
+func (m *Client) UnmarshalJSON(data []byte) error {
+	return errors.New("logplexc.Client: cannot be decoded from " +
+		"JSON, only its Stats can")
+}
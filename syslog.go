@@ -0,0 +1,113 @@
+package logplexc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether a string can be a syslog header field as-is: RFC 5424
+// restricts those to printable US-ASCII, which excludes space.
+func isPrintUSASCII(s string) bool {
+	for i := 0; i < len(s); i += 1 {
+		if s[i] < 33 || s[i] > 126 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Replace every character of a hostname that RFC 5424 disallows in
+// the HOSTNAME field with '?'.
+//
+// This is lossy, but leaves ASCII hostnames untouched and keeps
+// mostly-ASCII ones recognizable.
+func NormalizeHost(host string) string {
+	if isPrintUSASCII(host) {
+		return host
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '?'
+		}
+
+		return r
+	}, host)
+}
+
+// Base64-encode a hostname if it contains bytes that RFC 5424
+// disallows in the HOSTNAME field, otherwise leave it be.
+func encodeHost(host string) string {
+	if isPrintUSASCII(host) {
+		return host
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(host))
+}
+
+// Longest MSGID permitted by RFC 5424.
+const maxMsgIdLen = 32
+
+// Derive a MSGID from a procId: the component name that precedes the
+// first '.' or '/', as in "web" for "web.1".  NILVALUE is returned
+// when there is nothing usable.
+func msgIdFromProcId(procId string) string {
+	if i := strings.IndexAny(procId, "./"); i >= 0 {
+		procId = procId[:i]
+	}
+
+	if len(procId) > maxMsgIdLen {
+		procId = procId[:maxMsgIdLen]
+	}
+
+	if procId == "" || !isPrintUSASCII(procId) {
+		return "-"
+	}
+
+	return procId
+}
+
+// Split the first frame off of a run of framed messages, as written by
+// frame: "<length> <message>".  Both the whole frame and the message
+// within it are returned.
+func nextFrame(data []byte) (whole, msg, rest []byte, err error) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp <= 0 {
+		return nil, nil, nil, errors.New("logplexc: bad frame length")
+	}
+
+	n, err := strconv.Atoi(string(data[:sp]))
+	if err != nil || n < 0 || sp+1+n > len(data) {
+		return nil, nil, nil, errors.New("logplexc: bad frame length")
+	}
+
+	end := sp + 1 + n
+	return data[:end], data[sp+1 : end], data[end:], nil
+}
+
+// The TIMESTAMP of a syslog message, which follows "<PRI>VERSION ".
+func syslogTimestamp(msg []byte) (time.Time, error) {
+	fields := bytes.SplitN(msg, []byte(" "), 3)
+	if len(fields) < 3 {
+		return time.Time{}, errors.New(
+			"logplexc: truncated syslog header")
+	}
+
+	return time.Parse(time.RFC3339, string(fields[1]))
+}
+
+// The PROCID of a syslog message, which follows "<PRI>VERSION
+// TIMESTAMP HOSTNAME APP-NAME ".  Empty if the header is truncated.
+func syslogProcId(msg []byte) string {
+	fields := bytes.SplitN(msg, []byte(" "), 6)
+	if len(fields) < 6 {
+		return ""
+	}
+
+	return string(fields[4])
+}
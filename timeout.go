@@ -0,0 +1,149 @@
+package logplexc
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned, wrapped, by a post that took longer than
+// Config.WriteTimeout to send.
+type writeTimeoutError struct{}
+
+func (writeTimeoutError) Error() string {
+	return "logplexc: timed out writing request"
+}
+
+func (writeTimeoutError) Timeout() bool   { return true }
+func (writeTimeoutError) Temporary() bool { return true }
+
+// Returned, wrapped, by a post that Logplex took longer than
+// Config.ResponseTimeout to respond to.
+type responseTimeoutError struct{}
+
+func (responseTimeoutError) Error() string {
+	return "logplexc: timed out awaiting response"
+}
+
+func (responseTimeoutError) Timeout() bool   { return true }
+func (responseTimeoutError) Temporary() bool { return true }
+
+// The phases of a request that a timeoutTripper can time out.
+const (
+	phaseNone int32 = iota
+	phaseWrite
+	phaseResponse
+)
+
+// An http.RoundTripper that abandons requests that take longer than
+// write to write, from having a connection to having written the
+// whole body, or longer than response to respond, from then until
+// the first byte of the response.  Either is unlimited when zero,
+// and reading the rest of the response is never limited.
+type timeoutTripper struct {
+	next     http.RoundTripper
+	write    time.Duration
+	response time.Duration
+}
+
+func (tt *timeoutTripper) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	next := tt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	var phase int32
+	var timedOut int32
+
+	// Move on to phase p, timing it for d if non-zero.  A phase
+	// can be entered again, restarting its timer, as a request
+	// can get a connection more than once when net/http retries
+	// it, but an earlier phase cannot.
+	enter := func(p int32, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if p < phase {
+			return
+		}
+
+		phase = p
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+
+		if d > 0 {
+			timer = time.AfterFunc(d, func() {
+				atomic.StoreInt32(&timedOut, p)
+				cancel()
+			})
+		}
+	}
+
+	done := func() { enter(phaseResponse+1, 0) }
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			enter(phaseWrite, tt.write)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			enter(phaseResponse, tt.response)
+		},
+		GotFirstResponseByte: done,
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	resp, err := next.RoundTrip(req)
+	done()
+
+	if err != nil {
+		cancel()
+
+		switch atomic.LoadInt32(&timedOut) {
+		case phaseWrite:
+			return nil, writeTimeoutError{}
+		case phaseResponse:
+			return nil, responseTimeoutError{}
+		}
+
+		return nil, err
+	}
+
+	// The context has to outlive the reading of the body.
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (tt *timeoutTripper) CloseIdleConnections() {
+	next := tt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if ci, ok := next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// A response body that cancels the context of its request once
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,227 @@
+package logplexc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Derive the http.Client a Client's MiniClient posts with from the
+// Config.
+func configureHttpClient(cfg *Config) (http.Client, error) {
+	client := cfg.HttpClient
+
+	// Options that are applied to the http.Transport.
+	if cfg.UseHTTP2 || cfg.TLSConfig != nil ||
+		cfg.PinnedCertSHA256 != "" || cfg.LogplexTLSServerName != "" ||
+		cfg.LocalAgent != "" || cfg.MaxIdleConns > 0 ||
+		cfg.IdleConnTimeout > 0 || cfg.DisableKeepAlives {
+		t, err := cloneTransport(client.Transport)
+		if err != nil {
+			return client, err
+		}
+
+		if cfg.UseHTTP2 {
+			t.ForceAttemptHTTP2 = true
+		}
+
+		if cfg.TLSConfig != nil {
+			t.TLSClientConfig = cfg.TLSConfig.Clone()
+		} else if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+
+		if cfg.LogplexTLSServerName != "" {
+			t.TLSClientConfig.ServerName = cfg.LogplexTLSServerName
+		}
+
+		if cfg.PinnedCertSHA256 != "" {
+			err := pinCertificate(t.TLSClientConfig,
+				cfg.PinnedCertSHA256)
+			if err != nil {
+				return client, err
+			}
+		}
+
+		if cfg.LocalAgent != "" {
+			path := cfg.LocalAgent
+			t.Proxy = nil
+			t.DialContext = func(ctx context.Context,
+				network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+		}
+
+		if cfg.MaxIdleConns > 0 {
+			t.MaxIdleConns = cfg.MaxIdleConns
+			t.MaxIdleConnsPerHost = cfg.MaxIdleConns
+		}
+
+		if cfg.IdleConnTimeout > 0 {
+			t.IdleConnTimeout = cfg.IdleConnTimeout
+		}
+
+		if cfg.DisableKeepAlives {
+			t.DisableKeepAlives = true
+		}
+
+		client.Transport = t
+	}
+
+	if cfg.WriteTimeout > 0 || cfg.ResponseTimeout > 0 {
+		client.Transport = &timeoutTripper{
+			next:     client.Transport,
+			write:    cfg.WriteTimeout,
+			response: cfg.ResponseTimeout,
+		}
+	}
+
+	if cfg.TraceHTTP {
+		w := cfg.TraceWriter
+		if w == nil {
+			w = os.Stderr
+		}
+
+		client.Transport = &traceTripper{next: client.Transport, w: w}
+	}
+
+	return client, nil
+}
+
+// Require the leaf certificate of every server tlsConfig connects to
+// to have the SHA-256 digest pin, which is hex-encoded.  This is in
+// addition to whatever verification tlsConfig already does.
+//
+// The pin is checked in VerifyConnection rather than
+// VerifyPeerCertificate, which is skipped when a session is resumed.
+func pinCertificate(tlsConfig *tls.Config, pin string) error {
+	want, err := hex.DecodeString(pin)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("logplexc.Client: pinned certificate "+
+			"digest %q is not a hex-encoded SHA-256 digest", pin)
+	}
+
+	verify := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New(
+				"logplexc.Client: server sent no certificate")
+		}
+
+		got := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(got[:], want) {
+			return fmt.Errorf("logplexc.Client: server "+
+				"certificate digest %x does not match pin",
+				got)
+		}
+
+		if verify != nil {
+			return verify(cs)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// Copy a RoundTripper that is an *http.Transport, or
+// http.DefaultTransport if nil, so that it can be configured without
+// affecting anybody else using the original.
+func cloneTransport(rt http.RoundTripper) (*http.Transport, error) {
+	switch rt := rt.(type) {
+	case nil:
+		return http.DefaultTransport.(*http.Transport).Clone(), nil
+	case *http.Transport:
+		return rt.Clone(), nil
+	default:
+		return nil, fmt.Errorf("logplexc.Client: transport options "+
+			"require an *http.Transport, not %T", rt)
+	}
+}
+
+// Headers worth seeing when debugging connectivity to Logplex.
+var (
+	traceRequestHeaders = []string{
+		"Content-Type", "Content-Length", "Logplex-Msg-Count",
+	}
+
+	traceResponseHeaders = []string{
+		"Content-Type", "Content-Length", "Request-Id",
+	}
+)
+
+// An http.RoundTripper that writes a line about every request and
+// its response.
+type traceTripper struct {
+	next http.RoundTripper
+
+	// Serializes writes from concurrent requests.
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (tt *traceTripper) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	next := tt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	line := fmt.Sprintf("logplexc: %s %s",
+		req.Method, req.URL.Redacted())
+	line += traceHeaders(req.Header, traceRequestHeaders)
+
+	if err != nil {
+		line += fmt.Sprintf(" -> error %v (%v)\n", err, elapsed)
+	} else {
+		line += fmt.Sprintf(" -> %s", resp.Status)
+		line += traceHeaders(resp.Header, traceResponseHeaders)
+		line += fmt.Sprintf(" (%v)\n", elapsed)
+	}
+
+	tt.mu.Lock()
+	io.WriteString(tt.w, line)
+	tt.mu.Unlock()
+
+	return resp, err
+}
+
+// Pass on CloseIdleConnections to the wrapped transport, which
+// http.Client would otherwise be unable to see.
+func (tt *traceTripper) CloseIdleConnections() {
+	next := tt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if ci, ok := next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+func traceHeaders(h http.Header, keys []string) string {
+	s := ""
+	for _, k := range keys {
+		if v := h.Get(k); v != "" {
+			s += fmt.Sprintf(" %s=%q", k, v)
+		}
+	}
+
+	return s
+}
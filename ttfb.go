@@ -0,0 +1,47 @@
+package logplexc
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Records when a request has been written and when the first byte of
+// its response arrived, for working out how long Logplex took to
+// start responding.
+type ttfbTrace struct {
+	mu    sync.Mutex
+	wrote time.Time
+	first time.Time
+}
+
+// Derive a context that records into the ttfbTrace the progress of
+// the request made with it.
+func (tt *ttfbTrace) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.first = time.Now()
+		},
+	})
+}
+
+// The time from having written the request until the first byte of
+// the response, if both happened.
+func (tt *ttfbTrace) ttfb() (time.Duration, bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.wrote.IsZero() || tt.first.Before(tt.wrote) {
+		return 0, false
+	}
+
+	return tt.first.Sub(tt.wrote), true
+}
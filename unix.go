@@ -0,0 +1,44 @@
+package logplexc
+
+import "net/url"
+
+// The Logplex URL posted to by NewUnixClient when the Config has
+// none: the forwarder on the other end of the socket decides where
+// messages go.
+var unixLogplexUrl = url.URL{Scheme: "http", Host: "localhost", Path: "/logs"}
+
+// Create a Client that posts to a drain forwarder listening on the
+// Unix socket at socketPath, rather than over the network.
+//
+// This is a Client configured with Config.LocalAgent set to
+// socketPath, so messages are framed and posted exactly as they
+// would be to Logplex.  If cfg.Logplex has no host, the requests are
+// made for http://localhost/logs.  Close, after flushing, closes the
+// connections to the socket.
+func NewUnixClient(socketPath string, cfg *Config) (*Client, error) {
+	unixCfg := *cfg
+	unixCfg.LocalAgent = socketPath
+
+	if unixCfg.Logplex.Host == "" {
+		unixCfg.Logplex = unixLogplexUrl
+	}
+
+	// Set up before NewClient, which starts goroutines that may
+	// read onClose; m is assigned by the time Close can run it.
+	var m *Client
+	onClose := cfg.OnClose
+	unixCfg.OnClose = func() {
+		m.c.CloseIdleConnections()
+
+		if onClose != nil {
+			onClose()
+		}
+	}
+
+	m, err := NewClient(&unixCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,90 @@
+package logplexc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Recent rates are computed over this many one-second buckets.
+const rateWindowSeconds = 60
+
+// Counts of recent activity in one-second buckets, for computing
+// rates over the last minute.
+//
+// The bucket being counted into is updated atomically, so that
+// counting costs no locking; once a second it is folded into the ring
+// of completed buckets, which is protected by statLock.
+type rateWindow struct {
+	curMessages uint64
+	curBundles  uint64
+
+	messages [rateWindowSeconds]uint64
+	bundles  [rateWindowSeconds]uint64
+	next     int
+	filled   int
+
+	// When the current bucket began.
+	curStart time.Time
+}
+
+func (w *rateWindow) countMessages(n uint64) {
+	atomic.AddUint64(&w.curMessages, n)
+}
+
+func (w *rateWindow) countBundle() {
+	atomic.AddUint64(&w.curBundles, 1)
+}
+
+// Complete the current bucket and begin another.
+func (w *rateWindow) tick(now time.Time) {
+	w.messages[w.next] = atomic.SwapUint64(&w.curMessages, 0)
+	w.bundles[w.next] = atomic.SwapUint64(&w.curBundles, 0)
+	w.next = (w.next + 1) % rateWindowSeconds
+	if w.filled < rateWindowSeconds {
+		w.filled += 1
+	}
+
+	w.curStart = now
+}
+
+// Average messages and bundles per second over the window, including
+// the partial current bucket.
+func (w *rateWindow) rates(now time.Time) (messages, bundles float64) {
+	msgs := atomic.LoadUint64(&w.curMessages)
+	bdls := atomic.LoadUint64(&w.curBundles)
+
+	for i := 0; i < w.filled; i += 1 {
+		msgs += w.messages[i]
+		bdls += w.bundles[i]
+	}
+
+	span := float64(w.filled) + now.Sub(w.curStart).Seconds()
+	if span <= 0 {
+		return 0, 0
+	}
+
+	return float64(msgs) / span, float64(bdls) / span
+}
+
+// Advance the rate window every second until the Client is closed.
+func (m *Client) tickRateWindow() {
+	defer func() { m.finalizeDone.Done() }()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-m.finalize:
+			return
+		}
+
+		m.statLock.Lock()
+		m.rateWindow.tick(now)
+		m.statLock.Unlock()
+
+		m.checkDropRate(now)
+	}
+}